@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AuditFileEnv overrides the default audit file location
+const AuditFileEnv = "CSTU_AUDIT_FILE"
+
+// ciVariables identify the CI job a run belongs to
+var ciVariables = []string{
+	"CI_JOB_ID", "CI_JOB_URL", "CI_PIPELINE_ID", "CI_PROJECT_PATH",
+	"BUILD_NUMBER", "BUILD_URL", "JOB_NAME",
+	"GITHUB_RUN_ID", "GITHUB_REPOSITORY", "GITHUB_WORKFLOW",
+}
+
+// AuditRecord is a line of the audit file, written for every CloudStack call
+// that changes something
+type AuditRecord struct {
+	Time        time.Time         `json:"time"`
+	User        string            `json:"user"`
+	Host        string            `json:"host"`
+	CI          map[string]string `json:"ci,omitempty"`
+	Command     string            `json:"command"`
+	Environment string            `json:"environment"`
+	Zone        string            `json:"zone,omitempty"`
+	Template    string            `json:"template"`
+	TemplateID  string            `json:"templateID,omitempty"`
+	// the resource changed when it is not the template, e.g. a VM
+	ResourceID string            `json:"resourceID,omitempty"`
+	JobID      string            `json:"jobID,omitempty"`
+	Result     string            `json:"result"`
+	Error      string            `json:"error,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// DefaultAuditFile is $CSTU_AUDIT_FILE, or ~/.cstu/audit.jsonl
+func DefaultAuditFile() (string, error) {
+	if path := os.Getenv(AuditFileEnv); path != "" {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".cstu", "audit.jsonl"), nil
+}
+
+// CIJob returns the CI job identifiers set in the environment
+func CIJob() map[string]string {
+	job := make(map[string]string)
+
+	for _, name := range ciVariables {
+		if v := os.Getenv(name); v != "" {
+			job[name] = v
+		}
+	}
+
+	if len(job) == 0 {
+		return nil
+	}
+
+	return job
+}
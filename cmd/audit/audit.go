@@ -0,0 +1,205 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/myENA/cstu/cmd"
+	"github.com/rs/zerolog"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	synopsisMessage = "Queries the audit log of CloudStack changes"
+	helpMessage     = `
+cstu audit lists the CloudStack changes recorded by cstu upload, oldest first.
+--since takes a duration such as 24h or a date such as 2006-01-02.
+`
+)
+
+// Command represents the audit subcommand
+type Command struct {
+	Self string
+	Log  zerolog.Logger
+
+	cfs *flag.FlagSet
+
+	file     string
+	template string
+	id       string
+	env      string
+	zone     string
+	command  string
+	since    string
+	failed   bool
+	json     bool
+}
+
+func (c *Command) setupFlags(args []string) error {
+	c.cfs = flag.NewFlagSet("audit", flag.ExitOnError)
+	c.cfs.StringVar(&c.file, "audit-file", "", "Audit file to query (default $"+cmd.AuditFileEnv+" or ~/.cstu/audit.jsonl)")
+	c.cfs.StringVar(&c.template, "template", "", "Only changes of templates with this name")
+	c.cfs.StringVar(&c.id, "id", "", "Only changes of this template or resource id")
+	c.cfs.StringVar(&c.env, "env", "", "Only changes in this environment")
+	c.cfs.StringVar(&c.zone, "zone", "", "Only changes in this zone")
+	c.cfs.StringVar(&c.command, "command", "", "Only this api command, e.g. deleteTemplate")
+	c.cfs.StringVar(&c.since, "since", "", "Only changes since a duration ago or a date")
+	c.cfs.BoolVar(&c.failed, "failed", false, "Only changes that failed")
+	c.cfs.BoolVar(&c.json, "json", false, "Print the matching records as JSON Lines")
+
+	return c.cfs.Parse(args)
+}
+
+func (c *Command) Run(args []string) int {
+	if err := c.setupFlags(args); err != nil {
+		c.Log.Error().Msgf("%s", err)
+		return 1
+	}
+
+	since, err := parseSince(c.since)
+
+	if err != nil {
+		c.Log.Error().Msgf("%s", err)
+		return 1
+	}
+
+	if c.file == "" {
+		if c.file, err = cmd.DefaultAuditFile(); err != nil {
+			c.Log.Error().Msgf("Unable to find the audit file location: %s", err)
+			return 1
+		}
+	}
+
+	f, err := os.Open(c.file)
+
+	if err != nil {
+		c.Log.Error().Msgf("Unable to open audit file: %s", err)
+		return 1
+	}
+
+	defer f.Close()
+
+	records, err := c.query(f, since)
+
+	if err != nil {
+		c.Log.Error().Msgf("Unable to read audit file %s: %s", c.file, err)
+		return 1
+	}
+
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			enc.Encode(r)
+		}
+
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUSER\tENV\tZONE\tCOMMAND\tTEMPLATE\tTEMPLATE ID\tRESOURCE ID\tJOB ID\tRESULT")
+
+	for _, r := range records {
+		result := r.Result
+		if r.Error != "" {
+			result += ": " + r.Error
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format(time.RFC3339), r.User, r.Environment,
+			r.Zone, r.Command, r.Template, r.TemplateID, r.ResourceID, r.JobID, result)
+	}
+
+	w.Flush()
+
+	return 0
+}
+
+// query returns the records of r matching the flags
+func (c *Command) query(r io.Reader, since time.Time) ([]cmd.AuditRecord, error) {
+	var records []cmd.AuditRecord
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+
+		var rec cmd.AuditRecord
+
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			// a run killed while writing leaves a partial line, which must not hide the rest
+			c.Log.Warn().Msgf("Skipping unreadable audit record on line %d: %s", line, err)
+			continue
+		}
+
+		if c.matches(rec, since) {
+			records = append(records, rec)
+		}
+	}
+
+	return records, s.Err()
+}
+
+func (c *Command) matches(r cmd.AuditRecord, since time.Time) bool {
+	switch {
+	case c.template != "" && r.Template != c.template:
+		return false
+	case c.id != "" && r.TemplateID != c.id && r.ResourceID != c.id:
+		return false
+	case c.env != "" && r.Environment != c.env:
+		return false
+	case c.zone != "" && r.Zone != c.zone:
+		return false
+	case c.command != "" && !strings.EqualFold(r.Command, c.command):
+		return false
+	case c.failed && r.Error == "":
+		return false
+	case r.Time.Before(since):
+		return false
+	}
+
+	return true
+}
+
+// parseSince reads a duration ago or a date, the zero time when empty
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, since, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("--since must be a duration such as 24h or a date such as 2006-01-02")
+}
+
+func (c *Command) Synopsis() string {
+	return synopsisMessage
+}
+
+func (c *Command) Help() string {
+	if c.cfs == nil {
+		c.setupFlags(nil)
+	}
+
+	b := &bytes.Buffer{}
+	c.cfs.SetOutput(b)
+	c.cfs.Usage()
+	b.WriteString(helpMessage)
+
+	return b.String()
+}
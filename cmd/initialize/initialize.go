@@ -24,12 +24,12 @@ func (c *Command) Run(args []string) int {
 	config, err := yaml.Marshal(configYaml)
 
 	if err != nil {
-		c.Log.Error().Err(err)
+		c.Log.Error().Err(err).Msg("Unable to encode blank template config")
 		return 1
 	}
 
 	if err := ioutil.WriteFile("template.yml", config, 0766); err != nil {
-		c.Log.Error().Err(err)
+		c.Log.Error().Err(err).Msg("Unable to write template.yml")
 		return 1
 	}
 
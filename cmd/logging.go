@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"regexp"
+	"sync"
+)
+
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+
+	redacted = "REDACTED"
+)
+
+// secretParams matches credentials passed as url query parameters, such as
+// CloudStack api keys and signatures or presigned object storage urls
+var secretParams = regexp.MustCompile(`(?i)\b(apikey|apisecret|secretkey|signature|x-amz-signature|x-amz-credential|x-amz-security-token)=[^&\s"]+`)
+
+// Redactor writes log output with secrets masked
+type Redactor struct {
+	out io.Writer
+
+	mu      sync.RWMutex
+	secrets [][]byte
+}
+
+func NewRedactor(out io.Writer) *Redactor {
+	return &Redactor{out: out}
+}
+
+// AddSecret masks s wherever it appears in later log output
+func (r *Redactor) AddSecret(s string) {
+	// very short values would mask unrelated text
+	if len(s) < 6 {
+		return
+	}
+
+	r.mu.Lock()
+	r.secrets = append(r.secrets, []byte(s))
+	r.mu.Unlock()
+}
+
+func (r *Redactor) Write(p []byte) (int, error) {
+	out := secretParams.ReplaceAll(p, []byte("$1="+redacted))
+
+	r.mu.RLock()
+	for _, s := range r.secrets {
+		out = bytes.Replace(out, s, []byte(redacted), -1)
+	}
+	r.mu.RUnlock()
+
+	if _, err := r.out.Write(out); err != nil {
+		return 0, err
+	}
+
+	// the caller wrote all of p, however long the redacted output was
+	return len(p), nil
+}
+
+// NewLogger creates a logger writing to r in the console or json format at level
+func NewLogger(r *Redactor, format, level string) (zerolog.Logger, error) {
+	lvl, err := zerolog.ParseLevel(level)
+
+	if err != nil || level == "" {
+		return zerolog.Logger{}, fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+	}
+
+	var logger zerolog.Logger
+
+	switch format {
+	case LogFormatConsole:
+		logger = zerolog.New(zerolog.ConsoleWriter{Out: r})
+	case LogFormatJSON:
+		logger = zerolog.New(r)
+	default:
+		return zerolog.Logger{}, fmt.Errorf("unknown log format %q, use %s or %s", format, LogFormatConsole, LogFormatJSON)
+	}
+
+	return logger.Level(lvl).With().Timestamp().Logger(), nil
+}
@@ -0,0 +1,232 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiErrorCode finds the error code in errors returned by go-cloudstack,
+// e.g. "CloudStack API error 530 (CSExceptionErrorCode: 4250): ..."
+var apiErrorCode = regexp.MustCompile(`CloudStack API error (\d+)`)
+
+// transient reports whether a failed API call may succeed when repeated:
+// network errors, 5xx responses and throttling. A certificate that failed
+// verification fails again, so TLS errors are not.
+func transient(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		switch e.Err.(type) {
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+			return false
+		}
+
+		return !strings.Contains(e.Err.Error(), "x509: ")
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if m := apiErrorCode.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code == 429 || code >= 500
+	}
+
+	// a load balancer error page is not json, so decoding the response fails
+	return strings.Contains(err.Error(), "invalid character '<'")
+}
+
+// permissionDenied reports whether an API call was refused for the account
+// of the api key, which CloudStack answers with error 531
+func permissionDenied(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if e, ok := err.(*apiError); ok {
+		return e.ErrorCode == 531
+	}
+
+	m := apiErrorCode.FindStringSubmatch(err.Error())
+
+	return m != nil && m[1] == "531"
+}
+
+// backoff is the jittered exponential wait before retry attempt n
+func (c *Command) backoff(n int) time.Duration {
+	wait := c.args.apiRetryWait << uint(n)
+
+	if wait <= 0 || wait > c.args.apiRetryMaxWait {
+		wait = c.args.apiRetryMaxWait
+	}
+
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// call runs an idempotent CloudStack API command for the current
+// environment/zone, counting it in the metrics and retrying transient failures
+func (c *Command) call(command string, fn func() error) error {
+	return c.callChecked(command, fn, nil)
+}
+
+// callChecked runs a CloudStack API command that must not simply be repeated.
+// Before every retry, tookEffect reports whether the failed attempt went
+// through after all, in which case it must fill in the result itself.
+func (c *Command) callChecked(command string, fn func() error, tookEffect func() (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+
+		c.metrics.apiCall(c.args.Name, c.envName, c.zoneName, command, err)
+
+		if err == nil || !transient(err) || attempt >= c.args.apiRetries {
+			return err
+		}
+
+		wait := c.backoff(attempt)
+		c.Log.Warn().Msgf("%s failed, retrying in %s (%d/%d): %s", command, wait.Round(time.Millisecond), attempt+1, c.args.apiRetries, err)
+
+		if sleepContext(c.ctx, wait) != nil {
+			return err
+		}
+
+		if tookEffect == nil {
+			continue
+		}
+
+		done, checkErr := tookEffect()
+
+		if checkErr != nil {
+			// repeating a call that may have gone through risks doing it twice
+			c.Log.Error().Msgf("Unable to check whether %s went through, not retrying: %s", command, checkErr)
+			return err
+		}
+
+		if done {
+			c.Log.Info().Msgf("%s went through despite the error", command)
+			return nil
+		}
+	}
+}
+
+// apiError is an error response of the CloudStack api, formatted like the
+// errors of go-cloudstack so transient finds the code
+type apiError struct {
+	ErrorCode   int    `json:"errorcode"`
+	CSErrorCode int    `json:"cserrorcode"`
+	ErrorText   string `json:"errortext"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("CloudStack API error %d (CSExceptionErrorCode: %d): %s", e.ErrorCode, e.CSErrorCode, e.ErrorText)
+}
+
+// signParams signs api params the way CloudStack verifies them: keys sorted
+// and left as they are, only values escaped, all lower cased
+func signParams(params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+
+	for _, k := range keys {
+		for _, v := range params[k] {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+
+			// keys such as details[0].rootDiskController must not be escaped
+			b.WriteString(k + "=" + url.QueryEscape(v))
+		}
+	}
+
+	signed := strings.ToLower(strings.Replace(b.String(), "+", "%20", -1))
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// apiRequest sends a signed request for an api command go-cloudstack does not
+// fully cover, decoding the command's response object into result
+func (c *Command) apiRequest(command string, query url.Values, result interface{}) error {
+	// retries must not sign over the signature of the previous attempt
+	params := url.Values{}
+	for k, v := range query {
+		params[k] = v
+	}
+
+	params.Set("command", command)
+	params.Set("response", "json")
+	params.Set("apiKey", c.env.APIKey)
+
+	params.Set("signature", signParams(params, c.env.APISecret))
+
+	req, err := http.NewRequest(http.MethodPost, c.env.APIURL, strings.NewReader(params.Encode()))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// the transport of the client binds the request to the run
+	resp, err := c.httpClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	var wrapped map[string]json.RawMessage
+
+	if err := json.Unmarshal(body, &wrapped); err != nil {
+		return err
+	}
+
+	inner, ok := wrapped[strings.ToLower(command)+"response"]
+
+	if !ok && resp.StatusCode >= 500 {
+		return &apiError{ErrorCode: resp.StatusCode, ErrorText: resp.Status}
+	}
+
+	if !ok {
+		return fmt.Errorf("unexpected %s response: %s", command, body)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &apiError{}
+
+		if err := json.Unmarshal(inner, e); err != nil {
+			return err
+		}
+
+		return e
+	}
+
+	return json.Unmarshal(inner, result)
+}
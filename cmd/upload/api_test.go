@@ -0,0 +1,288 @@
+package upload
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"github.com/myENA/cstu/cmd"
+	"github.com/rs/zerolog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const (
+	testAPIKey    = "plgWJfZK4gyS3mOMTVmjUVg-X-jlWlnfaUJ9GAbBbf9EdM-kAYMmAiLqzzq1ElZLYq_u38zCm0bewzGUdP66mg"
+	testAPISecret = "VDaACYb0LV9eNjTetIOElcVQkvJck_J_QljX_FcHRj87ZKiy0z0ty0ZsYBkoXkY9b7eq1EhwJaw7FF3akA3KBQ"
+)
+
+func TestSignParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		params url.Values
+		want   string
+	}{
+		{
+			// the example of the CloudStack API documentation
+			name: "documented example",
+			params: url.Values{
+				"apiKey":   {testAPIKey},
+				"command":  {"listUsers"},
+				"response": {"json"},
+			},
+			want: "TTpdDq/7j/J58XCRHomKoQXEQds=",
+		},
+		{
+			name: "indexed keys and spaces",
+			params: url.Values{
+				"apiKey":                        {testAPIKey},
+				"command":                       {"registerTemplate"},
+				"details[0].rootDiskController": {"scsi"},
+				"name":                          {"my template"},
+				"response":                      {"json"},
+			},
+			want: "vKMNYeUtsKuJPNbnvM9Apb7wcQY=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signParams(tt.params, testAPISecret); got != tt.want {
+				t.Errorf("signParams() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"url error", &url.Error{Op: "Post", URL: "https://cloud/client/api", Err: errors.New("connection refused")}, true},
+		{"unknown authority", &url.Error{Op: "Post", URL: "https://cloud/client/api", Err: x509.UnknownAuthorityError{}}, false},
+		{"wrong host", &url.Error{Op: "Post", URL: "https://cloud/client/api", Err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "cloud"}}, false},
+		{"wrapped certificate error", &url.Error{Op: "Post", URL: "https://cloud/client/api", Err: errors.New("tls: failed to verify certificate: x509: certificate has expired")}, false},
+		{"net error", timeoutError{}, true},
+		{"rate limited", &apiError{ErrorCode: 429, ErrorText: "too many requests"}, true},
+		{"server error", &apiError{ErrorCode: 530, CSErrorCode: 4250, ErrorText: "internal error"}, true},
+		{"server error message", errors.New("CloudStack API error 503 (CSExceptionErrorCode: 0): unavailable"), true},
+		{"parameter error", &apiError{ErrorCode: 431, CSErrorCode: 4350, ErrorText: "unable to find template"}, false},
+		{"not authenticated", &apiError{ErrorCode: 401, ErrorText: "unable to verify user credentials"}, false},
+		{"html error page", errors.New("invalid character '<' looking for beginning of value"), true},
+		{"other error", errors.New("template not found"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transient(tt.err); got != tt.want {
+				t.Errorf("transient(%q) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"account error", &apiError{ErrorCode: 531, CSErrorCode: 4365, ErrorText: "Parameter expunge can be passed by Admin only"}, true},
+		{"account error message", errors.New("CloudStack API error 531 (CSExceptionErrorCode: 4365): Parameter expunge can be passed by Admin only"), true},
+		{"parameter error", &apiError{ErrorCode: 431, ErrorText: "unable to find vm"}, false},
+		{"server error", errors.New("CloudStack API error 530 (CSExceptionErrorCode: 4250): internal error"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permissionDenied(tt.err); got != tt.want {
+				t.Errorf("permissionDenied(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		id        string
+		code      int
+		transient bool
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   `{"registertemplateresponse":{"count":1,"template":[{"id":"t1","name":"sles"}]}}`,
+			id:     "t1",
+		},
+		{
+			name:   "parameter error",
+			status: 431,
+			body:   `{"registertemplateresponse":{"uuidList":[],"errorcode":431,"cserrorcode":4350,"errortext":"Unable to find zone"}}`,
+			code:   431,
+		},
+		{
+			name:      "server error",
+			status:    530,
+			body:      `{"registertemplateresponse":{"uuidList":[],"errorcode":530,"cserrorcode":4250,"errortext":"Internal error"}}`,
+			code:      530,
+			transient: true,
+		},
+		{
+			name:      "load balancer page",
+			status:    http.StatusBadGateway,
+			body:      `<html><body>502 Bad Gateway</body></html>`,
+			transient: true,
+		},
+		{
+			name:      "other json",
+			status:    http.StatusServiceUnavailable,
+			body:      `{"error":"maintenance"}`,
+			code:      http.StatusServiceUnavailable,
+			transient: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil || r.PostForm.Get("signature") == "" {
+					t.Errorf("request not signed: %v", r.PostForm)
+				}
+
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			c := &Command{
+				ctx:        context.Background(),
+				env:        cmd.CloudstackEnvironment{APIURL: srv.URL, APIKey: testAPIKey, APISecret: testAPISecret},
+				httpClient: srv.Client(),
+			}
+
+			var resp registerTemplateResponse
+			err := c.apiRequest("registerTemplate", url.Values{"name": {"sles"}}, &resp)
+
+			if tt.id != "" {
+				if err != nil || len(resp.Template) != 1 || resp.Template[0].Id != tt.id {
+					t.Fatalf("apiRequest() = %v, %+v, want template %s", err, resp, tt.id)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("apiRequest() succeeded, want an error")
+			}
+
+			if e, ok := err.(*apiError); ok != (tt.code != 0) || (ok && e.ErrorCode != tt.code) {
+				t.Errorf("apiRequest() error = %#v, want api error code %d", err, tt.code)
+			}
+
+			if transient(err) != tt.transient {
+				t.Errorf("transient(%q) = %t, want %t", err, !tt.transient, tt.transient)
+			}
+		})
+	}
+}
+
+func TestCallChecked(t *testing.T) {
+	errServer := &apiError{ErrorCode: 530, ErrorText: "internal error"}
+	errParam := &apiError{ErrorCode: 431, ErrorText: "invalid parameter"}
+
+	tests := []struct {
+		name       string
+		results    []error
+		tookEffect func() (bool, error)
+		calls      int
+		fails      bool
+	}{
+		{name: "success", results: []error{nil}, calls: 1},
+		{name: "retried", results: []error{errServer, errServer, nil}, calls: 3},
+		{name: "not transient", results: []error{errParam, nil}, calls: 1, fails: true},
+		{name: "out of retries", results: []error{errServer, errServer, errServer, errServer}, calls: 3, fails: true},
+		{
+			name:       "went through",
+			results:    []error{errServer, nil},
+			tookEffect: func() (bool, error) { return true, nil },
+			calls:      1,
+		},
+		{
+			name:       "did not go through",
+			results:    []error{errServer, nil},
+			tookEffect: func() (bool, error) { return false, nil },
+			calls:      2,
+		},
+		{
+			name:       "unable to check",
+			results:    []error{errServer, nil},
+			tookEffect: func() (bool, error) { return false, errors.New("timeout") },
+			calls:      1,
+			fails:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Command{
+				Log:     zerolog.Nop(),
+				ctx:     context.Background(),
+				metrics: newMetrics(),
+				args:    &Options{apiRetries: 2, apiRetryWait: time.Millisecond, apiRetryMaxWait: 2 * time.Millisecond},
+			}
+
+			calls := 0
+			err := c.callChecked("createTags", func() error {
+				calls++
+				return tt.results[calls-1]
+			}, tt.tookEffect)
+
+			if (err != nil) != tt.fails {
+				t.Errorf("callChecked() error = %v, want error %t", err, tt.fails)
+			}
+
+			if calls != tt.calls {
+				t.Errorf("callChecked() made %d calls, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestCallCheckedCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c := &Command{
+		Log:     zerolog.Nop(),
+		ctx:     ctx,
+		metrics: newMetrics(),
+		args:    &Options{apiRetries: 4, apiRetryWait: time.Hour, apiRetryMaxWait: time.Hour},
+	}
+
+	calls := 0
+	err := c.call("listTemplates", func() error {
+		calls++
+		return &apiError{ErrorCode: 503}
+	})
+
+	if err == nil || calls != 1 {
+		t.Errorf("call() = %v after %d calls, want the error of the only call", err, calls)
+	}
+}
@@ -0,0 +1,118 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/myENA/cstu/cmd"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	auditSucceeded = "succeeded"
+	auditFailed    = "failed"
+)
+
+// auditLog appends a record to the audit file for every CloudStack mutation
+type auditLog struct {
+	path string
+	user string
+	host string
+	ci   map[string]string
+
+	mu sync.Mutex
+}
+
+// openAudit checks the audit file can be written before anything is changed
+func openAudit(path string) (*auditLog, error) {
+	if path == "" {
+		var err error
+		if path, err = cmd.DefaultAuditFile(); err != nil {
+			return nil, fmt.Errorf("unable to find the audit file location: %s", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create the audit file directory: %s", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit file: %s", err)
+	}
+
+	f.Close()
+
+	a := &auditLog{path: path, ci: cmd.CIJob()}
+
+	if u, err := user.Current(); err == nil {
+		a.user = u.Username
+	}
+
+	a.host, _ = os.Hostname()
+
+	return a, nil
+}
+
+// write appends r as a single line, so records of concurrent runs do not mix
+func (a *auditLog) write(r cmd.AuditRecord) error {
+	r.User = a.user
+	r.Host = a.host
+	r.CI = a.ci
+
+	data, err := json.Marshal(r)
+
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// audit records a CloudStack mutation of the current environment/zone.
+// templID is the template it concerns, details what was changed.
+func (c *Command) audit(command, templID, resourceID, jobID string, details map[string]string, err error) {
+	if c.auditLog == nil {
+		return
+	}
+
+	r := cmd.AuditRecord{
+		Time:        time.Now().UTC(),
+		Command:     command,
+		Environment: c.envName,
+		Zone:        c.zoneName,
+		Template:    c.args.Name,
+		TemplateID:  templID,
+		ResourceID:  resourceID,
+		JobID:       jobID,
+		Result:      auditSucceeded,
+		Details:     details,
+	}
+
+	if err != nil {
+		r.Result = auditFailed
+		r.Error = err.Error()
+	}
+
+	if err := c.auditLog.write(r); err != nil {
+		c.Log.Error().Msgf("Unable to write audit record for %s to %s: %s", command, c.auditLog.path, err)
+	}
+}
@@ -0,0 +1,76 @@
+package upload
+
+import (
+	"fmt"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+)
+
+// autoScaleProfiles returns the autoscale VM profiles in the current zone that
+// deploy from a template. Profiles of any owner count, as templates may be
+// shared with other accounts and projects.
+func (c *Command) autoScaleProfiles(cs *cloudstack.CloudStackClient, templID string) ([]*cloudstack.AutoScaleVmProfile, error) {
+	params := cs.AutoScale.NewListAutoScaleVmProfilesParams()
+	params.SetTemplateid(templID)
+	params.SetZoneid(c.args.zoneID)
+	params.SetListall(true)
+
+	var resp *cloudstack.ListAutoScaleVmProfilesResponse
+	err := c.call("listAutoScaleVmProfiles", func() error {
+		var err error
+		resp, err = cs.AutoScale.ListAutoScaleVmProfiles(params)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []*cloudstack.AutoScaleVmProfile
+
+	for _, p := range resp.AutoScaleVmProfiles {
+		if p.Templateid == templID {
+			profiles = append(profiles, p)
+		}
+	}
+
+	return profiles, nil
+}
+
+// moveAutoScaleProfiles points the autoscale VM profiles deploying from the
+// old template at the new one, so scaling out keeps working once the old
+// template is deleted. It returns the ids of the profiles it updated.
+func (c *Command) moveAutoScaleProfiles(cs *cloudstack.CloudStackClient, oldID, newID string) ([]string, error) {
+	profiles, err := c.autoScaleProfiles(cs, oldID)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to list autoscale VM profiles using template %s: %s", oldID, err)
+	}
+
+	var moved []string
+
+	for _, p := range profiles {
+		c.Log.Info().Msgf("Moving autoscale VM profile %s from template %s to %s", p.Id, oldID, newID)
+
+		params := cs.AutoScale.NewUpdateAutoScaleVmProfileParams(p.Id)
+		params.SetTemplateid(newID)
+
+		var jobID string
+		err := c.call("updateAutoScaleVmProfile", func() error {
+			resp, err := cs.AutoScale.UpdateAutoScaleVmProfile(params)
+			if err == nil {
+				jobID = resp.JobID
+			}
+			return err
+		})
+
+		c.audit("updateAutoScaleVmProfile", newID, p.Id, jobID, map[string]string{"oldTemplateID": oldID}, err)
+
+		if err != nil {
+			return moved, fmt.Errorf("unable to move autoscale VM profile %s to template %s: %s", p.Id, newID, err)
+		}
+
+		moved = append(moved, p.Id)
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,166 @@
+package upload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/myENA/cstu/cmd"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultAPITimeout   = 60 * time.Second
+	defaultAsyncTimeout = 5 * time.Minute
+)
+
+// newClient creates the CloudStack client of an environment using its
+// transport settings
+func (c *Command) newClient(e cmd.CloudstackEnvironment) (*cloudstack.CloudStackClient, error) {
+	t := e.Transport
+
+	if t == nil {
+		t = &cmd.Transport{}
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+
+	if t.InsecureSkipVerify {
+		c.Log.Warn().Msgf("Not verifying the certificate of %s, the api keys can be intercepted", e.APIURL)
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle for %s: %s", e.Name, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("certFile and keyFile must be set together for %s", e.Name)
+		}
+
+		pair, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate for %s: %s", e.Name, err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	proxy := http.ProxyFromEnvironment
+
+	if t.Proxy != "" {
+		u, err := url.Parse(t.Proxy)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s for %s: %s", t.Proxy, e.Name, err)
+		}
+
+		proxy = http.ProxyURL(u)
+	}
+
+	timeout, err := parseTimeout(t.Timeout, defaultAPITimeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	asyncTimeout, err := parseTimeout(t.AsyncTimeout, defaultAsyncTimeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: &contextTransport{
+			c:       c,
+			timeout: timeout,
+			next: &http.Transport{
+				Proxy:               proxy,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+	}
+
+	// kept for the api commands sent without go-cloudstack
+	c.env = e
+	c.httpClient = client
+	c.asyncTimeout = asyncTimeout
+
+	return cloudstack.NewAsyncClient(e.APIURL, e.APIKey, e.APISecret, !t.InsecureSkipVerify,
+		cloudstack.WithHTTPClient(client), cloudstack.WithAsyncTimeout(int64(asyncTimeout.Seconds()))), nil
+}
+
+// contextTransport binds the api requests of the run to its context, which
+// go-cloudstack does not take, so an interrupt aborts the requests in flight.
+// Requests made after the interrupt belong to the cleanup and are bound to
+// its own, limited context instead. Replacing the context of a request drops
+// the deadline of http.Client.Timeout, so the transport applies the timeout.
+type contextTransport struct {
+	c       *Command
+	timeout time.Duration
+	next    http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := t.c.ctx
+
+	if parent.Err() != nil {
+		parent = t.c.cleanupCtx
+	}
+
+	ctx, cancel := context.WithTimeout(parent, t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the timeout covers reading the body as well
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// cancelBody releases the context of a request once its response is read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func parseTimeout(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(s)
+
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %s, use a positive duration such as 60s", s)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,51 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContextTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	c := &Command{}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.cleanupCtx, c.cleanupCancel = context.WithCancel(context.Background())
+	defer c.cleanupCancel()
+
+	client := &http.Client{Transport: &contextTransport{c: c, timeout: time.Minute, next: http.DefaultTransport}}
+
+	// an interrupt aborts the requests in flight
+	time.AfterFunc(50*time.Millisecond, c.cancel)
+	if _, err := client.Get(srv.URL + "/slow"); err == nil {
+		t.Fatal("request in flight was not aborted by the interrupt")
+	}
+
+	// the cleanup after it still reaches the api
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("cleanup request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	c.cleanupCancel()
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Error("request made after the cleanup was cancelled succeeded")
+	}
+
+	timed := &http.Client{Transport: &contextTransport{c: &Command{ctx: context.Background()}, timeout: 50 * time.Millisecond, next: http.DefaultTransport}}
+	if _, err := timed.Get(srv.URL + "/slow"); err == nil {
+		t.Error("slow request did not time out")
+	}
+}
@@ -1,9 +1,12 @@
 package upload
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/xanzy/go-cloudstack/cloudstack"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -12,7 +15,12 @@ func (c *Command) getOSID(cs *cloudstack.CloudStackClient, osName string) (strin
 	osID := ""
 	typesParams := &cloudstack.ListOsTypesParams{}
 	typesParams.SetDescription(osName)
-	osTypes, err := cs.GuestOS.ListOsTypes(typesParams)
+	var osTypes *cloudstack.ListOsTypesResponse
+	err := c.call("listOsTypes", func() error {
+		var err error
+		osTypes, err = cs.GuestOS.ListOsTypes(typesParams)
+		return err
+	})
 
 	if err != nil {
 		return "", err
@@ -30,7 +38,12 @@ func (c *Command) getOSID(cs *cloudstack.CloudStackClient, osName string) (strin
 	}
 
 	if osID == "" {
-		osTypes, err := cs.GuestOS.ListOsTypes(nil)
+		var osTypes *cloudstack.ListOsTypesResponse
+		err := c.call("listOsTypes", func() error {
+			var err error
+			osTypes, err = cs.GuestOS.ListOsTypes(&cloudstack.ListOsTypesParams{})
+			return err
+		})
 
 		if err != nil {
 			return "", err
@@ -41,49 +54,304 @@ func (c *Command) getOSID(cs *cloudstack.CloudStackClient, osName string) (strin
 	return osID, nil
 }
 
-func (c *Command) checkTemplateExists(cs *cloudstack.CloudStackClient, templateName, zoneID string) *cloudstack.Template {
+// findTemplates lists the templates of the owner matching the params set by filter
+func (c *Command) findTemplates(cs *cloudstack.CloudStackClient, filter func(*cloudstack.ListTemplatesParams)) ([]*cloudstack.Template, error) {
+	// only templates of the key's own account unless another owner is set
+	templateFilter := "self"
+	if c.owner.projectID != "" || c.owner.account != "" {
+		templateFilter = "all"
+	}
+
+	params := cs.Template.NewListTemplatesParams(templateFilter)
+	filter(params)
 
-	template, _, err := cs.Template.GetTemplateByName(templateName, "all", zoneID)
+	if c.owner.projectID != "" {
+		params.SetProjectid(c.owner.projectID)
+	}
+
+	if c.owner.account != "" {
+		params.SetDomainid(c.owner.domainID)
+		params.SetAccount(c.owner.account)
+	}
+
+	var resp *cloudstack.ListTemplatesResponse
+	err := c.call("listTemplates", func() error {
+		var err error
+		resp, err = cs.Template.ListTemplates(params)
+		return err
+	})
 
 	if err != nil {
-		c.Log.Info().Msgf("%s", err)
-		return nil
+		return nil, err
 	}
 
-	if template == nil {
-		return nil
+	// a template of another owner must never be picked, whatever the api returned
+	var owned []*cloudstack.Template
+
+	for _, t := range resp.Templates {
+		if c.owner.owns(t) {
+			owned = append(owned, t)
+		}
+	}
+
+	return owned, nil
+}
+
+// getTemplate looks up a template of the owner by id in the current zone
+func (c *Command) getTemplate(cs *cloudstack.CloudStackClient, templateID string) (*cloudstack.Template, error) {
+	templates, err := c.findTemplates(cs, func(p *cloudstack.ListTemplatesParams) {
+		p.SetId(templateID)
+		if c.args.zoneID != "" {
+			p.SetZoneid(c.args.zoneID)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(templates) == 0 {
+		return nil, templateNotFound(templateID)
+	}
+
+	return templates[0], nil
+}
+
+// getZoneID looks up a zone by name
+func (c *Command) getZoneID(cs *cloudstack.CloudStackClient, zone string) (string, error) {
+	var zoneID string
+	err := c.call("listZones", func() error {
+		var err error
+		zoneID, _, err = cs.Zone.GetZoneID(zone)
+		return err
+	})
+
+	return zoneID, err
+}
+
+// checkTemplateExists finds the template the new one replaces, and any
+// duplicates with the same name
+func (c *Command) checkTemplateExists(cs *cloudstack.CloudStackClient, templateName, zoneID string) (*cloudstack.Template, []*cloudstack.Template, error) {
+	var templates []*cloudstack.Template
+	var err error
+
+	// versioned names differ every run, the alias finds the current one
+	if c.args.Alias != "" {
+		templates, err = c.aliasTemplates(cs, zoneID)
+	} else {
+		templates, err = c.listTemplates(cs, templateName, zoneID)
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to look for existing templates named %s: %s", templateName, err)
+	}
+
+	return c.selectExisting(templates)
+}
+
+// listTemplates returns every template of the owner named name in a zone
+func (c *Command) listTemplates(cs *cloudstack.CloudStackClient, name, zoneID string) ([]*cloudstack.Template, error) {
+	templates, err := c.findTemplates(cs, func(p *cloudstack.ListTemplatesParams) {
+		p.SetName(name)
+		p.SetZoneid(zoneID)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var named []*cloudstack.Template
+
+	for _, t := range templates {
+		if t.Name == name {
+			named = append(named, t)
+		}
 	}
 
-	return template
+	return named, nil
 }
 
-func (c *Command) registerTemplate(cs *cloudstack.CloudStackClient) (*cloudstack.RegisterTemplateResponse, error) {
+// registerTemplateResponse holds the templates created by registerTemplate
+type registerTemplateResponse struct {
+	Count    int `json:"count"`
+	Template []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"template"`
+}
+
+// registerParams are the registerTemplate parameters of the template, with
+// the options of its hypervisor applied
+func (c *Command) registerParams(templateURL, templateTag string) url.Values {
+	a := c.args
+
+	bits := a.Bits
+	isDynamic := a.IsDynamic
+	requiresHVM := a.RequiresHVM
+	directDownload := a.DirectDownload
+	deployAsIs := a.DeployAsIs
+	templateType := a.TemplateType
+
+	details := make(map[string]string)
+	for k, v := range a.Details {
+		details[k] = v
+	}
+
+	for hv, o := range a.HypervisorOptions {
+		if !strings.EqualFold(hv, a.HyperVisor) {
+			continue
+		}
+
+		if o.Bits != 0 {
+			bits = o.Bits
+		}
+		if o.IsDynamic != nil {
+			isDynamic = *o.IsDynamic
+		}
+		if o.RequiresHVM != nil {
+			requiresHVM = *o.RequiresHVM
+		}
+		if o.DirectDownload != nil {
+			directDownload = *o.DirectDownload
+		}
+		if o.DeployAsIs != nil {
+			deployAsIs = *o.DeployAsIs
+		}
+		if o.TemplateType != "" {
+			templateType = o.TemplateType
+		}
+		for k, v := range o.Details {
+			details[k] = v
+		}
+	}
 
-	templateURL := fmt.Sprintf("%s/%s.qcow2", c.urlPath, c.args.Name)
+	p := url.Values{}
+	p.Set("name", a.Name)
+	p.Set("displaytext", a.DisplayText)
+	p.Set("format", strings.ToUpper(a.Format))
+	p.Set("hypervisor", a.HyperVisor)
+	p.Set("ostypeid", a.osID)
+	p.Set("url", templateURL)
+	p.Set("zoneid", a.zoneID)
+	p.Set("ispublic", strconv.FormatBool(a.IsPublic))
+	p.Set("isfeatured", strconv.FormatBool(a.IsFeatured))
+	p.Set("passwordenabled", strconv.FormatBool(a.PasswordEnabled))
+	p.Set("isrouting", strconv.FormatBool(a.IsRouting))
+	p.Set("requireshvm", strconv.FormatBool(requiresHVM))
+	p.Set("isdynamicallyscalable", strconv.FormatBool(isDynamic))
+	p.Set("isextractable", strconv.FormatBool(a.IsExtractable))
+	p.Set("sshkeyenabled", strconv.FormatBool(a.SSHKeyEnabled))
+
+	if bits != 0 {
+		p.Set("bits", strconv.Itoa(bits))
+	}
+	if a.Checksum != "" {
+		p.Set("checksum", a.Checksum)
+	}
+	if directDownload {
+		p.Set("directdownload", "true")
+	}
+	if deployAsIs {
+		p.Set("deployasis", "true")
+	}
+	if templateType != "" {
+		p.Set("templatetype", strings.ToUpper(templateType))
+	}
+	if templateTag != "" {
+		p.Set("templatetag", templateTag)
+	}
+
+	// every detail goes in the first map, e.g. details[0].rootDiskController=scsi
+	for k, v := range details {
+		p.Set(fmt.Sprintf("details[0].%s", k), v)
+	}
+
+	if c.owner.projectID != "" {
+		p.Set("projectid", c.owner.projectID)
+	}
+	if c.owner.account != "" {
+		p.Set("domainid", c.owner.domainID)
+		p.Set("account", c.owner.account)
+	}
+
+	return p
+}
+
+// registerTemplate registers the template in the current zone, with templateTag
+// when set, and returns its id
+func (c *Command) registerTemplate(cs *cloudstack.CloudStackClient, templateTag string) (string, error) {
+	// templates that already carry the name, so the new one can be told apart
+	existing, err := c.listTemplates(cs, c.args.Name, c.args.zoneID)
+
+	if err != nil {
+		return "", err
+	}
+
+	before := make(map[string]bool)
+	for _, t := range existing {
+		before[t.Id] = true
+	}
+
+	templateURL := c.templateURL()
 
 	c.Log.Info().Msgf("Registering template at url: %s", templateURL)
 
-	regParams := cs.Template.NewRegisterTemplateParams(c.args.DisplayText, strings.ToUpper(c.args.Format),
-		c.args.HyperVisor, c.args.Name, c.args.osID, templateURL, c.args.zoneID)
-	regParams.SetIspublic(c.args.IsPublic)
-	regParams.SetIsfeatured(c.args.IsFeatured)
-	regParams.SetPasswordenabled(c.args.PasswordEnabled)
-	regParams.SetIsrouting(c.args.IsRouting)
-	regParams.SetRequireshvm(c.args.RequiresHVM)
-	regParams.SetIsdynamicallyscalable(c.args.IsDynamic)
-	regParams.SetIsextractable(c.args.IsExtractable)
-	if c.args.ProjectID != "" {
-		regParams.SetProjectid(c.args.ProjectID)
+	params := c.registerParams(templateURL, templateTag)
+
+	var newID string
+	err = c.callChecked("registerTemplate", func() error {
+		var resp registerTemplateResponse
+
+		// go-cloudstack misses parameters such as deployasis and templatetype
+		if err := c.apiRequest("registerTemplate", params, &resp); err != nil {
+			return err
+		}
+
+		c.Log.Info().Msg("Grabbing new template ID")
+		for _, t := range resp.Template {
+			if t.Name == c.args.Name && !before[t.Id] {
+				newID = t.Id
+				break
+			}
+		}
+
+		return nil
+	}, func() (bool, error) {
+		// registering twice would download the template twice under the same name
+		templates, err := c.listTemplates(cs, c.args.Name, c.args.zoneID)
+
+		if err != nil {
+			return false, err
+		}
+
+		for _, t := range templates {
+			if t.Name == c.args.Name && !before[t.Id] {
+				newID = t.Id
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+
+	if err == nil && newID == "" {
+		err = fmt.Errorf("CloudStack did not return an ID for the new template %s", c.args.Name)
 	}
-	regParams.SetSshkeyenabled(c.args.SSHKeyEnabled)
 
-	regParams.SetIspublic(true)
+	c.audit("registerTemplate", newID, "", "", map[string]string{
+		"hypervisor": c.args.HyperVisor,
+		"format":     c.args.Format,
+		"zoneID":     c.args.zoneID,
+	}, err)
 
-	return cs.Template.RegisterTemplate(regParams)
+	if err != nil {
+		return "", err
+	}
 
+	return newID, nil
 }
 
-func (c *Command) watchRegisteredTemplate(cs *cloudstack.CloudStackClient, templateID string) error {
+func (c *Command) watchRegisteredTemplate(ctx context.Context, cs *cloudstack.CloudStackClient, templateID string) error {
 	var watch = true
 	var watched int
 	watchLimit := 20
@@ -93,22 +361,29 @@ func (c *Command) watchRegisteredTemplate(cs *cloudstack.CloudStackClient, templ
 			return errors.New("Template is taking longer than expected to upload, cancelling upload")
 		}
 
-		templ, _, err := cs.Template.GetTemplateByID(templateID, "all")
+		templ, err := c.getTemplate(cs, templateID)
 
 		if err != nil {
 			return err
 		}
 
 		c.Log.Info().Msgf("Checking if template %s is ready: %t status: %s", c.args.Name, templ.Isready, templ.Status)
+		c.logDownloadProgress()
 
 		if !templ.Isready {
 			if !strings.Contains(templ.Status, "Downloaded") && templ.Status != "" && templ.Status != "Installing Template" && templ.Status != "Download Complete" {
-				return fmt.Errorf("connection error to %s with status: %s, please check the url and try again", c.urlPath, templ.Status)
+				return fmt.Errorf("connection error to %s with status: %s, please check the url and try again", c.templateURL(), templ.Status)
 			}
 
 			watch = true
 			watched += 1
-			time.Sleep(sleepTimer * time.Second)
+			if err := sleepContext(ctx, sleepTimer*time.Second); err != nil {
+				return err
+			}
+
+			if err := c.renewLeases(cs); err != nil {
+				return err
+			}
 
 		} else {
 			watch = false
@@ -119,14 +394,42 @@ func (c *Command) watchRegisteredTemplate(cs *cloudstack.CloudStackClient, templ
 	return nil
 }
 
-func (c *Command) deleteExistingTemplate(cs *cloudstack.CloudStackClient, existing string) {
+func (c *Command) deleteExistingTemplate(cs *cloudstack.CloudStackClient, existing string) bool {
+
+	// only ever delete templates of the owner
+	if _, err := c.getTemplate(cs, existing); err != nil {
+		c.Log.Error().Msgf("Not deleting template id %s, it was not found for %s: %s", existing, c.owner, err)
+		return false
+	}
 
 	delParams := cs.Template.NewDeleteTemplateParams(existing)
 
-	delResp, err := cs.Template.DeleteTemplate(delParams)
+	var delResp *cloudstack.DeleteTemplateResponse
+	err := c.callChecked("deleteTemplate", func() error {
+		var err error
+		delResp, err = cs.Template.DeleteTemplate(delParams)
+		return err
+	}, func() (bool, error) {
+		_, err := c.getTemplate(cs, existing)
+
+		if _, gone := err.(templateNotFound); gone {
+			return true, nil
+		}
+
+		return false, err
+	})
 
 	if err != nil {
+		c.audit("deleteTemplate", existing, "", "", nil, err)
 		c.Log.Error().Msgf("Error deleting template id %s: %s", existing, err)
+		return false
+	}
+
+	// a retry found the template already deleted
+	if delResp == nil {
+		c.audit("deleteTemplate", existing, "", "", nil, nil)
+		c.Log.Info().Msgf("Successfully deleted template id: %s", existing)
+		return true
 	}
 
 	success, err := c.getJobStatus(cs, delResp.JobID)
@@ -135,29 +438,70 @@ func (c *Command) deleteExistingTemplate(cs *cloudstack.CloudStackClient, existi
 		c.Log.Error().Msgf("Error deleting template id %s: %s", existing, err)
 	}
 
+	if !success && err == nil {
+		err = fmt.Errorf("job %s failed", delResp.JobID)
+	}
+
+	c.audit("deleteTemplate", existing, "", delResp.JobID, nil, err)
+
 	if !success {
 		c.Log.Error().Msgf("Error deleting %s, you may need to manually delete the template from CloudStack", existing)
-		return
+		return false
 	}
 
 	c.Log.Info().Msgf("Successfully deleted template id: %s", existing)
 
+	return true
 }
 
-func (c *Command) createResourceTags(cs *cloudstack.CloudStackClient, templID string) error {
+// createTags adds tags to a template
+func (c *Command) createTags(cs *cloudstack.CloudStackClient, templID string, tags map[string]string) error {
 
 	resourceIds := []string{templID}
 
-	tagsReqParams := cs.Resourcetags.NewCreateTagsParams(resourceIds, "Template", c.args.ResourceTags)
+	tagsReqParams := cs.Resourcetags.NewCreateTagsParams(resourceIds, "Template", tags)
 
-	resp, err := cs.Resourcetags.CreateTags(tagsReqParams)
+	var resp *cloudstack.CreateTagsResponse
+	err := c.callChecked("createTags", func() error {
+		var err error
+		resp, err = cs.Resourcetags.CreateTags(tagsReqParams)
+		return err
+	}, func() (bool, error) {
+		// tags that already exist can not be created again
+		current, err := c.listTags(cs, templID)
+
+		if err != nil {
+			return false, err
+		}
+
+		for k, v := range tags {
+			if value, ok := current[k]; !ok || value != v {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	})
 
 	if err != nil {
+		c.audit("createTags", templID, "", "", tags, err)
 		return err
 	}
 
+	if resp == nil {
+		c.audit("createTags", templID, "", "", tags, nil)
+		return nil
+	}
+
 	success, err := c.getJobStatus(cs, resp.JobID)
 
+	auditErr := err
+	if !success && err == nil {
+		auditErr = fmt.Errorf("job %s failed", resp.JobID)
+	}
+
+	c.audit("createTags", templID, "", resp.JobID, tags, auditErr)
+
 	if err != nil {
 		return fmt.Errorf("error creating resource tags for %s: %s", templID, err)
 	}
@@ -167,15 +511,91 @@ func (c *Command) createResourceTags(cs *cloudstack.CloudStackClient, templID st
 
 	}
 
-	c.Log.Info().Msgf("Successfully created resource tags for: %s", templID)
-
 	return nil
 }
 
+// deleteTags removes tags from a template
+func (c *Command) deleteTags(cs *cloudstack.CloudStackClient, templID string, tags map[string]string) error {
+	params := cs.Resourcetags.NewDeleteTagsParams([]string{templID}, "Template")
+	params.SetTags(tags)
+
+	var resp *cloudstack.DeleteTagsResponse
+	err := c.callChecked("deleteTags", func() error {
+		var err error
+		resp, err = cs.Resourcetags.DeleteTags(params)
+		return err
+	}, func() (bool, error) {
+		// tags that are gone can not be deleted again
+		current, err := c.listTags(cs, templID)
+
+		if err != nil {
+			return false, err
+		}
+
+		for k, v := range tags {
+			if value, ok := current[k]; ok && value == v {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	})
+
+	if err == nil && resp != nil && !resp.Success {
+		err = fmt.Errorf("deleting tags of %s failed: %s", templID, resp.Displaytext)
+	}
+
+	jobID := ""
+	if resp != nil {
+		jobID = resp.JobID
+	}
+
+	c.audit("deleteTags", templID, "", jobID, tags, err)
+
+	return err
+}
+
+// listTags returns the tags of a template
+func (c *Command) listTags(cs *cloudstack.CloudStackClient, templID string) (map[string]string, error) {
+	params := cs.Resourcetags.NewListTagsParams()
+	params.SetResourceid(templID)
+	params.SetResourcetype("Template")
+	if c.owner.projectID != "" {
+		params.SetProjectid(c.owner.projectID)
+	}
+	if c.owner.account != "" {
+		params.SetDomainid(c.owner.domainID)
+		params.SetAccount(c.owner.account)
+	}
+
+	var resp *cloudstack.ListTagsResponse
+	err := c.call("listTags", func() error {
+		var err error
+		resp, err = cs.Resourcetags.ListTags(params)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, t := range resp.Tags {
+		tags[t.Key] = t.Value
+	}
+
+	return tags, nil
+}
+
 func (c *Command) getJobStatus(cs *cloudstack.CloudStackClient, jobID string) (bool, error) {
 	asyncParams := cs.Asyncjob.NewQueryAsyncJobResultParams(jobID)
 
-	resp, err := cs.Asyncjob.QueryAsyncJobResult(asyncParams)
+	var resp *cloudstack.QueryAsyncJobResultResponse
+	err := c.call("queryAsyncJobResult", func() error {
+		var err error
+		resp, err = cs.Asyncjob.QueryAsyncJobResult(asyncParams)
+		return err
+	})
 
 	if err != nil {
 		return false, err
@@ -188,3 +608,38 @@ func (c *Command) getJobStatus(cs *cloudstack.CloudStackClient, jobID string) (b
 	return true, nil
 
 }
+
+// ssvmAddresses returns the public and private addresses of the secondary
+// storage VMs in a zone, the addresses templates are downloaded from
+func (c *Command) ssvmAddresses(cs *cloudstack.CloudStackClient, zoneID string) ([]string, error) {
+	params := cs.SystemVM.NewListSystemVmsParams()
+	params.SetSystemvmtype("secondarystoragevm")
+	params.SetZoneid(zoneID)
+
+	var resp *cloudstack.ListSystemVmsResponse
+	err := c.call("listSystemVms", func() error {
+		var err error
+		resp, err = cs.SystemVM.ListSystemVms(params)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+
+	for _, vm := range resp.SystemVms {
+		for _, ip := range []string{vm.Publicip, vm.Privateip} {
+			if ip != "" {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no secondary storage VM addresses found for zone %s", zoneID)
+	}
+
+	return addrs, nil
+}
@@ -4,12 +4,18 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 )
 
@@ -24,30 +30,11 @@ func (c *Command) newDockerClient() *client.Client {
 	return cli
 }
 
-func (c *Command) templateToWebRoot() error {
-	link := filepath.Join(webPath, c.args.Name+".qcow2")
-	cwd, err := os.Getwd()
-
-	if err != nil {
-		return err
-	}
-
-	if !filepath.IsAbs(c.args.TemplateFile) {
-		c.args.TemplateFile = filepath.Join(cwd, c.args.TemplateFile)
-	}
-
-	if _, err := os.Stat(link); os.IsNotExist(err) {
-		return os.Symlink(filepath.Clean(c.args.TemplateFile), link)
-	}
-
-	return nil
-}
-
-func (c *Command) runWebContainer() error {
+func (c *Command) runWebContainer(ctx context.Context) error {
 	cli := c.newDockerClient()
 
 	c.Log.Info().Msgf("Creating httpd container")
-	createResp, err := c.createContainer()
+	createResp, err := c.createContainer(ctx)
 
 	if err != nil {
 		c.Log.Info().Msgf("%s", err)
@@ -56,17 +43,16 @@ func (c *Command) runWebContainer() error {
 	}
 
 	c.Log.Info().Msgf("Running web server for upload: %s", c.urlPath)
+	c.cID = createResp.ID
+
 	if err := cli.ContainerStart(ctx, createResp.ID, types.ContainerStartOptions{}); err != nil {
-		c.Log.Error().Err(err)
 		return err
 	}
 
-	c.cID = createResp.ID
-
 	return nil
 }
 
-func (c *Command) pullHttpd() error {
+func (c *Command) pullHttpd(ctx context.Context) error {
 	cli := c.newDockerClient()
 
 	c.Log.Info().Msg("Pulling httpd:alpine")
@@ -74,66 +60,163 @@ func (c *Command) pullHttpd() error {
 	pullOpts := types.ImagePullOptions{All: true}
 
 	responseBody, err := cli.ImagePull(ctx, "httpd:alpine", pullOpts)
-	defer responseBody.Close()
 
 	if err != nil {
-		c.Log.Error().Msgf("Error pulling httpd:alpine: %s", err)
-		return err
+		return fmt.Errorf("error pulling httpd:alpine: %s", err)
+	}
+
+	defer responseBody.Close()
+
+	// the pull is only complete once the progress stream has been drained
+	if _, err := io.Copy(ioutil.Discard, responseBody); err != nil {
+		return fmt.Errorf("error pulling httpd:alpine: %s", err)
 	}
 
 	return nil
 
 }
 
-func (c *Command) createContainer() (container.ContainerCreateCreatedBody, error) {
+func (c *Command) createContainer(ctx context.Context) (container.ContainerCreateCreatedBody, error) {
 	cli := c.newDockerClient()
 
+	port := nat.Port("80/tcp")
+
 	config := &container.Config{
 		Image: "httpd:alpine",
-		ExposedPorts: nat.PortSet{
-			"80/tcp": struct{}{},
-		},
+	}
+
+	binds := []string{fmt.Sprintf("%s:/usr/local/apache2/htdocs/:ro", c.stagingDir)}
+
+	// a symlink is resolved inside the container, so its target has to be mounted at the same path
+	if c.args.stagingMode == stageSymlink {
+		templateDir := filepath.Dir(c.args.TemplateFile)
+		binds = append(binds, fmt.Sprintf("%s:%s:ro", templateDir, templateDir))
+	}
+
+	if c.args.tls {
+		certFile, keyFile, err := c.tlsFiles()
+
+		if err != nil {
+			return container.ContainerCreateCreatedBody{}, err
+		}
+
+		port = nat.Port("443/tcp")
+		config.Cmd = []string{"sh", "-c", httpdTLSCmd}
+		binds = append(binds,
+			fmt.Sprintf("%s:/usr/local/apache2/conf/server.crt:ro", certFile),
+			fmt.Sprintf("%s:/usr/local/apache2/conf/server.key:ro", keyFile),
+		)
+	}
+
+	config.ExposedPorts = nat.PortSet{
+		port: struct{}{},
 	}
 
 	hostConfig := &container.HostConfig{
-		Binds: []string{fmt.Sprintf("%s:/usr/local/apache2/htdocs/", webPath)},
+		Binds: binds,
 		PortBindings: nat.PortMap{
-			"80/tcp": []nat.PortBinding{
+			port: []nat.PortBinding{
 				{
-					HostIP:   "0.0.0.0",
-					HostPort: "80",
+					// bind every address family so IPv6 host addresses work too
+					HostIP:   "",
+					HostPort: strconv.Itoa(c.webPort),
 				},
 			},
 		},
 	}
 
-	return cli.ContainerCreate(ctx, config, hostConfig, nil, containerName)
+	return cli.ContainerCreate(ctx, config, hostConfig, nil, c.webName)
 }
 
-func (c *Command) deleteContainer(containerID string) error {
+func (c *Command) deleteContainer(ctx context.Context, containerID string) error {
 	cli := c.newDockerClient()
 
 	return cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: true})
 }
 
-func (c *Command) containerActive() error {
+func (c *Command) containerActive(ctx context.Context) error {
+	if err := c.waitServed(ctx, "Web container", c.localTemplateURL()); err != nil {
+		return err
+	}
+
+	if c.args.AdvertisedURL == "" {
+		return nil
+	}
+
+	return c.waitServed(ctx, "Advertised url", c.templateURL())
+}
+
+// waitServed polls url until the template can be fetched from it
+func (c *Command) waitServed(ctx context.Context, what, url string) error {
 	wait := true
 
 	for wait {
-		h := &http.Client{}
-		checkURL := fmt.Sprintf("http://%s", c.args.HostIP)
-		_, err := h.Get(checkURL)
+		err := probeServed(ctx, url)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
 		// The web container will refuse connection until it is ready
 		if err != nil {
-			c.Log.Info().Msg("Web container not ready, if this is taking unusually long please Ctrl+c and retry")
+			c.Log.Info().Msgf("%s %s not ready (%s), if this is taking unusually long please Ctrl+c and retry", what, url, err)
 			wait = true
-			time.Sleep(2 * time.Second)
+			if err := sleepContext(ctx, 2*time.Second); err != nil {
+				return err
+			}
 		} else {
-			c.Log.Info().Msg("Web container ready! Continuing")
+			c.Log.Info().Msgf("%s %s ready! Continuing", what, url)
 			wait = false
 		}
 	}
 
 	return nil
 }
+
+// probeServed makes a HEAD request for a template served by this host
+func probeServed(ctx context.Context, url string) error {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := localClient().Do(req.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// localClient is used to check that this host serves templates. It skips
+// certificate verification since a self-signed certificate may not be trusted
+// locally.
+func localClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// freePort asks the kernel for an unused tcp port for the web container
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", ":0")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,123 @@
+package upload
+
+import (
+	"fmt"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	replaceNewest = "newest"
+	replaceOldest = "oldest"
+	replaceFail   = "fail"
+
+	// layout of the created field of CloudStack responses
+	createdLayout = "2006-01-02T15:04:05-0700"
+)
+
+// replaceTag splits the replaceTag setting into its key and value
+func (c *Command) replaceTag() (string, string) {
+	parts := strings.SplitN(c.args.ReplaceTag, "=", 2)
+
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+func hasTag(t *cloudstack.Template, key, value string) bool {
+	for _, tag := range t.Tags {
+		if tag.Key == key && tag.Value == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func created(t *cloudstack.Template) time.Time {
+	ts, _ := time.Parse(createdLayout, t.Created)
+	return ts
+}
+
+// selectExisting picks the template to replace among the templates of the
+// owner with the name, following the replace rule. The other candidates are
+// returned as duplicates. With a replace tag, templates without it are
+// neither replaced nor counted as duplicates.
+func (c *Command) selectExisting(templates []*cloudstack.Template) (*cloudstack.Template, []*cloudstack.Template, error) {
+	candidates := templates
+
+	if c.args.ReplaceTag != "" {
+		key, value := c.replaceTag()
+		candidates = nil
+
+		for _, t := range templates {
+			if hasTag(t, key, value) {
+				candidates = append(candidates, t)
+			}
+		}
+
+		if skipped := len(templates) - len(candidates); skipped > 0 {
+			c.Log.Info().Msgf("Ignoring %d templates named %s without the tag %s", skipped, c.args.Name, c.args.ReplaceTag)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+
+	rule := c.args.ReplaceRule
+
+	if rule == "" {
+		rule = replaceNewest
+	}
+
+	if len(candidates) > 1 && rule == replaceFail {
+		var ids []string
+		for _, t := range candidates {
+			ids = append(ids, t.Id)
+		}
+
+		return nil, nil, fmt.Errorf("found %d templates named %s (%s), remove the extras or change replaceRule", len(candidates), c.args.Name, strings.Join(ids, ", "))
+	}
+
+	sorted := append([]*cloudstack.Template(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if rule == replaceOldest {
+			return created(sorted[i]).Before(created(sorted[j]))
+		}
+
+		return created(sorted[i]).After(created(sorted[j]))
+	})
+
+	return sorted[0], sorted[1:], nil
+}
+
+// deleteDuplicates removes the extra templates with the name once the new one is ready
+func (c *Command) deleteDuplicates(cs *cloudstack.CloudStackClient, entry *journalEntry, res *targetResult) error {
+	var left []string
+
+	for _, id := range entry.Duplicates {
+		c.Log.Info().Msgf("Deleting duplicate template id %s", id)
+
+		if !c.retireTemplate(cs, id, entry.NewID, res) {
+			c.releaseAlias(cs, id)
+			left = append(left, id)
+		}
+	}
+
+	entry.Duplicates = left
+
+	if err := c.journal.record(entry); err != nil {
+		return err
+	}
+
+	if len(left) > 0 {
+		return fmt.Errorf("new template %s is ready but duplicates %s were not removed, run again to retry", entry.NewID, strings.Join(left, ", "))
+	}
+
+	return nil
+}
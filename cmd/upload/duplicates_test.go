@@ -0,0 +1,75 @@
+package upload
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"testing"
+)
+
+func TestSelectExisting(t *testing.T) {
+	older := testTemplate("older")
+	older.Created = "2018-04-01T10:00:00+0000"
+	newer := testTemplate("newer")
+	newer.Created = "2018-04-10T10:00:00+0000"
+	newest := testTemplate("newest", "channel", "stable")
+	newest.Created = "2018-04-11T09:00:00-0500"
+
+	tests := []struct {
+		name       string
+		rule       string
+		replaceTag string
+		templates  []*cloudstack.Template
+		existing   string
+		duplicates []string
+		fails      bool
+	}{
+		{name: "none", templates: nil},
+		{name: "single", templates: []*cloudstack.Template{older}, existing: "older"},
+		{name: "newest by default", templates: []*cloudstack.Template{older, newest, newer}, existing: "newest", duplicates: []string{"newer", "older"}},
+		{name: "oldest", rule: replaceOldest, templates: []*cloudstack.Template{newer, newest, older}, existing: "older", duplicates: []string{"newer", "newest"}},
+		{name: "fail on several", rule: replaceFail, templates: []*cloudstack.Template{older, newer}, fails: true},
+		{name: "fail with one", rule: replaceFail, templates: []*cloudstack.Template{older}, existing: "older"},
+		{name: "replace tag", replaceTag: "channel=stable", templates: []*cloudstack.Template{older, newest, newer}, existing: "newest"},
+		{name: "replace tag missing", replaceTag: "channel=beta", templates: []*cloudstack.Template{older, newest}},
+		{name: "fail counts tagged only", rule: replaceFail, replaceTag: "channel=stable", templates: []*cloudstack.Template{older, newest}, existing: "newest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Command{Log: zerolog.Nop(), args: &Options{}}
+			c.args.Name = "sles"
+			c.args.ReplaceRule = tt.rule
+			c.args.ReplaceTag = tt.replaceTag
+
+			existing, duplicates, err := c.selectExisting(tt.templates)
+
+			if (err != nil) != tt.fails {
+				t.Fatalf("selectExisting() error = %v, want error %t", err, tt.fails)
+			}
+
+			var id string
+			if existing != nil {
+				id = existing.Id
+			}
+
+			if id != tt.existing {
+				t.Errorf("selectExisting() existing = %q, want %q", id, tt.existing)
+			}
+
+			var ids []string
+			for _, d := range duplicates {
+				ids = append(ids, d.Id)
+			}
+
+			if len(ids) != len(tt.duplicates) {
+				t.Fatalf("selectExisting() duplicates = %v, want %v", ids, tt.duplicates)
+			}
+
+			for i := range ids {
+				if ids[i] != tt.duplicates[i] {
+					t.Errorf("selectExisting() duplicates = %v, want %v", ids, tt.duplicates)
+				}
+			}
+		})
+	}
+}
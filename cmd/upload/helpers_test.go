@@ -0,0 +1,16 @@
+package upload
+
+import (
+	"github.com/xanzy/go-cloudstack/cloudstack"
+)
+
+// testTemplate returns a template with tags given as key, value pairs
+func testTemplate(id string, tags ...string) *cloudstack.Template {
+	t := &cloudstack.Template{Id: id, Name: "sles"}
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		t.Tags = append(t.Tags, cloudstack.Tags{Key: tags[i], Value: tags[i+1]})
+	}
+
+	return t
+}
@@ -0,0 +1,160 @@
+package upload
+
+import (
+	"fmt"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"strings"
+)
+
+// what to do with a replaced template VMs were deployed from
+const (
+	inUseSkip      = "skip"
+	inUseDeprecate = "deprecate"
+	inUseDelete    = "delete"
+
+	deprecatedPrefix = "DEPRECATED"
+
+	// how many instances are named in the log
+	inUseListed = 10
+)
+
+// retiredTemplate records what happened to a template that was replaced
+type retiredTemplate struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	// instances still deployed from the template
+	InUse     int      `json:"inUse"`
+	Instances []string `json:"instances,omitempty"`
+}
+
+func (r retiredTemplate) String() string {
+	if r.InUse == 0 {
+		return fmt.Sprintf("template %s %s", r.ID, r.Action)
+	}
+
+	return fmt.Sprintf("template %s %s, in use by %d instances: %s", r.ID, r.Action, r.InUse, strings.Join(r.Instances, ", "))
+}
+
+func (c *Command) inUsePolicy() string {
+	if c.args.InUsePolicy == "" {
+		return inUseSkip
+	}
+
+	return c.args.InUsePolicy
+}
+
+// templateInstances returns how many VMs were deployed from a template and the
+// names of the first of them. VMs of any owner count, as templates may be
+// shared with other accounts and projects.
+func (c *Command) templateInstances(cs *cloudstack.CloudStackClient, templID string) (int, []string, error) {
+	params := cs.VirtualMachine.NewListVirtualMachinesParams()
+	params.SetTemplateid(templID)
+	params.SetListall(true)
+	params.SetPage(1)
+	params.SetPagesize(inUseListed)
+
+	var resp *cloudstack.ListVirtualMachinesResponse
+	err := c.call("listVirtualMachines", func() error {
+		var err error
+		resp, err = cs.VirtualMachine.ListVirtualMachines(params)
+		return err
+	})
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var names []string
+
+	for _, vm := range resp.VirtualMachines {
+		names = append(names, fmt.Sprintf("%s (%s)", vm.Name, vm.Id))
+	}
+
+	return resp.Count, names, nil
+}
+
+// retireTemplate deletes a replaced template, unless VMs still use it and the
+// in-use policy keeps or deprecates it instead. It reports false when the
+// template could not be handled and should be tried again by a later run.
+func (c *Command) retireTemplate(cs *cloudstack.CloudStackClient, templID, newID string, res *targetResult) bool {
+	count, instances, err := c.templateInstances(cs, templID)
+
+	if err != nil {
+		// not knowing whether it is used is no reason to delete it
+		c.Log.Error().Msgf("Not deleting template id %s, unable to check whether instances use it: %s", templID, err)
+		return false
+	}
+
+	r := retiredTemplate{ID: templID, InUse: count, Instances: instances}
+
+	if count == 0 {
+		if !c.deleteExistingTemplate(cs, templID) {
+			return false
+		}
+
+		r.Action = "deleted"
+		res.Retired = append(res.Retired, r)
+
+		return true
+	}
+
+	c.Log.Warn().Msgf("Template id %s is in use by %d instances: %s", templID, count, strings.Join(instances, ", "))
+
+	switch c.inUsePolicy() {
+	case inUseDelete:
+		c.Log.Warn().Msgf("Deleting template id %s anyway as inUsePolicy is %s", templID, inUseDelete)
+
+		if !c.deleteExistingTemplate(cs, templID) {
+			return false
+		}
+
+		r.Action = "deleted while in use"
+	case inUseDeprecate:
+		if err := c.deprecateTemplate(cs, templID, newID); err != nil {
+			c.Log.Error().Msgf("Unable to deprecate template id %s: %s", templID, err)
+			return false
+		}
+
+		r.Action = "deprecated"
+		c.releaseAlias(cs, templID)
+	default:
+		c.Log.Info().Msgf("Keeping template id %s as inUsePolicy is %s", templID, inUseSkip)
+		r.Action = "kept"
+		c.releaseAlias(cs, templID)
+	}
+
+	res.Retired = append(res.Retired, r)
+
+	return true
+}
+
+// deprecateTemplate marks a replaced template in its display text so users
+// pick the new one
+func (c *Command) deprecateTemplate(cs *cloudstack.CloudStackClient, templID, newID string) error {
+	templ, err := c.getTemplate(cs, templID)
+
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(templ.Displaytext, deprecatedPrefix) {
+		return nil
+	}
+
+	displayText := fmt.Sprintf("%s, replaced by %s: %s", deprecatedPrefix, newID, templ.Displaytext)
+
+	c.Log.Info().Msgf("Deprecating template id %s", templID)
+
+	params := cs.Template.NewUpdateTemplateParams(templID)
+	params.SetDisplaytext(displayText)
+
+	// the text is built once, so a retry after an update that went through sets it again unchanged
+	err = c.call("updateTemplate", func() error {
+		_, err := cs.Template.UpdateTemplate(params)
+		return err
+	})
+
+	c.audit("updateTemplate", templID, "", "", map[string]string{"displayText": displayText}, err)
+
+	return err
+}
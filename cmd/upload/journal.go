@@ -0,0 +1,197 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journal records the progress of an upload for every environment/zone so
+// an interrupted run can be resumed with the same config and template
+type journal struct {
+	path    string
+	Config  string                   `json:"config"`
+	Targets map[string]*journalEntry `json:"targets"`
+	// identifies the locks of the run, so a resumed run takes them over
+	LockID string `json:"lockID,omitempty"`
+}
+
+// journalEntry holds the steps completed for a single environment/zone.
+// TemplateTag is the template tag of the replaced template, kept when none
+// is configured. OldDeleted is also set when the in-use policy kept the old
+// template.
+type journalEntry struct {
+	Environment string    `json:"environment"`
+	Zone        string    `json:"zone"`
+	Name        string    `json:"name,omitempty"`
+	DisplayText string    `json:"displayText,omitempty"`
+	Checked     bool      `json:"checked"`
+	ExistingID  string    `json:"existingID,omitempty"`
+	TemplateTag string    `json:"templateTag,omitempty"`
+	Duplicates  []string  `json:"duplicates,omitempty"`
+	NewID       string    `json:"newID,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Ready       bool      `json:"ready"`
+	Tested      bool      `json:"tested"`
+	Tagged      bool      `json:"tagged"`
+	OldDeleted  bool      `json:"oldDeleted"`
+	Done        bool      `json:"done"`
+	Updated     time.Time `json:"updated"`
+}
+
+// runFingerprint identifies what a run uploads: the config, the template and
+// the name it is registered as. A journal is only resumed by the same run, so
+// a new build of the template under an unchanged config starts over.
+func runFingerprint(config []byte, template, runName string) string {
+	h := sha256.New()
+	h.Write(config)
+
+	// separated by a byte yaml text and names never contain
+	for _, s := range []string{template, runName} {
+		h.Write([]byte{0})
+		h.Write([]byte(s))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// templateIdentity identifies the template of a run: its url when hosted
+// elsewhere, otherwise the path, size and modification time of the file,
+// which change with every build without reading the whole image
+func templateIdentity(file, url string) (string, error) {
+	if url != "" {
+		return url, nil
+	}
+
+	path, err := filepath.Abs(file)
+
+	if err != nil {
+		return "", err
+	}
+
+	fi, err := os.Stat(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%d:%d", path, fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// loadJournal reads the journal at path. A missing journal, or one written
+// for a different run, results in an empty journal.
+func loadJournal(path, fingerprint string) (*journal, bool, error) {
+	j := &journal{
+		path:    path,
+		Config:  fingerprint,
+		Targets: make(map[string]*journalEntry),
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return j, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	old := &journal{}
+	if err := json.Unmarshal(data, old); err != nil {
+		return nil, false, fmt.Errorf("unable to parse journal %s: %s", path, err)
+	}
+
+	if old.Config != fingerprint || old.Targets == nil {
+		return j, false, nil
+	}
+
+	j.Targets = old.Targets
+	j.LockID = old.LockID
+
+	return j, true, nil
+}
+
+// entry returns the journal entry for an environment/zone, creating it if needed
+func (j *journal) entry(env, zone string) *journalEntry {
+	key := env + "/" + zone
+
+	if e, ok := j.Targets[key]; ok {
+		return e
+	}
+
+	e := &journalEntry{Environment: env, Zone: zone}
+	j.Targets[key] = e
+
+	return e
+}
+
+// envDone reports whether every zone of an environment has completed
+func (j *journal) envDone(env string, zones []string) bool {
+	for _, z := range zones {
+		if e, ok := j.Targets[env+"/"+z]; !ok || !e.Done {
+			return false
+		}
+	}
+
+	return true
+}
+
+// save writes the journal to disk, replacing the previous copy atomically
+func (j *journal) save() error {
+	for _, e := range j.Targets {
+		if e.Updated.IsZero() {
+			e.Updated = time.Now()
+		}
+	}
+
+	data, err := json.MarshalIndent(j, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path))
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// record marks an entry as updated and persists the journal
+func (j *journal) record(e *journalEntry) error {
+	e.Updated = time.Now()
+
+	if err := j.save(); err != nil {
+		return fmt.Errorf("unable to write journal %s: %s", j.path, err)
+	}
+
+	return nil
+}
+
+// remove deletes the journal once every target has completed
+func (j *journal) remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunFingerprint(t *testing.T) {
+	base := runFingerprint([]byte("name: sles"), "https://example.com/sles.qcow2", "sles-20180411")
+
+	tests := []struct {
+		name     string
+		config   string
+		template string
+		runName  string
+		same     bool
+	}{
+		{"same run", "name: sles", "https://example.com/sles.qcow2", "sles-20180411", true},
+		{"changed config", "name: sles2", "https://example.com/sles.qcow2", "sles-20180411", false},
+		{"new template", "name: sles", "https://example.com/sles-2.qcow2", "sles-20180411", false},
+		{"new name", "name: sles", "https://example.com/sles.qcow2", "sles-20180412", false},
+		{"shifted boundary", "name: sles", "https://example.com/sles.qcow2sles", "-20180411", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runFingerprint([]byte(tt.config), tt.template, tt.runName); (got == base) != tt.same {
+				t.Errorf("runFingerprint() = %s, base %s, want same %t", got, base, tt.same)
+			}
+		})
+	}
+}
+
+func TestTemplateIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cstu-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "template.qcow2")
+	if err := ioutil.WriteFile(file, []byte("build 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, _ := templateIdentity(file, "https://example.com/t.qcow2"); id != "https://example.com/t.qcow2" {
+		t.Errorf("templateIdentity() with url = %s, want the url", id)
+	}
+
+	first, err := templateIdentity(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := templateIdentity(file, ""); again != first {
+		t.Errorf("templateIdentity() of an unchanged file = %s, want %s", again, first)
+	}
+
+	// a rebuild of the same size still changes the modification time
+	if err := ioutil.WriteFile(file, []byte("build 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if rebuilt, _ := templateIdentity(file, ""); rebuilt == first {
+		t.Errorf("templateIdentity() of a rebuilt file = %s, want it to change", rebuilt)
+	}
+
+	if _, err := templateIdentity(filepath.Join(dir, "missing.qcow2"), ""); err == nil {
+		t.Error("templateIdentity() of a missing file succeeded")
+	}
+}
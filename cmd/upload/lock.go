@@ -0,0 +1,509 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// lockTagKey is the tag leasing a template to the run replacing it
+	lockTagKey = "cstu-lock"
+
+	// claimTagKey marks, with the lock key, a template registered while there
+	// was none to replace, so concurrent runs see each other
+	claimTagKey = "cstu-claim"
+
+	defaultLockTTL = 2 * time.Hour
+)
+
+var unsafeLockChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// lockInfo is the content of a host lock file
+type lockInfo struct {
+	ID      string    `json:"id"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	User    string    `json:"user"`
+	Started time.Time `json:"started"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l lockInfo) String() string {
+	return fmt.Sprintf("pid %d of %s on %s since %s, expiring %s", l.PID, l.User, l.Host, l.Started.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
+
+// stale reports whether the run holding the lock is gone
+func (l lockInfo) stale(host string) bool {
+	if time.Now().After(l.Expires) {
+		return true
+	}
+
+	if l.Host != host {
+		return false
+	}
+
+	p, err := os.FindProcess(l.PID)
+
+	if err != nil {
+		return true
+	}
+
+	// signal 0 only checks the process exists
+	err = p.Signal(syscall.Signal(0))
+
+	return err != nil && err != syscall.EPERM
+}
+
+// lockKey is what runs updating the same template share: the alias, which
+// stays the same when the name changes between runs, or the name
+func (c *Command) lockKey() string {
+	if c.args.Alias != "" {
+		return c.args.Alias
+	}
+
+	return c.runName
+}
+
+// lockID identifies this run's locks, kept in the journal so a resumed run
+// takes over the leases of the interrupted one
+func (c *Command) lockID() (string, error) {
+	if c.journal.LockID != "" {
+		return c.journal.LockID, nil
+	}
+
+	b := make([]byte, 8)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	c.journal.LockID = hex.EncodeToString(b)
+
+	return c.journal.LockID, nil
+}
+
+// acquireHostLock makes sure no other run on this host updates the template
+func (c *Command) acquireHostLock() error {
+	id, err := c.lockID()
+
+	if err != nil {
+		return fmt.Errorf("unable to create lock id: %s", err)
+	}
+
+	host, _ := os.Hostname()
+
+	info := lockInfo{
+		ID:      id,
+		Host:    host,
+		PID:     os.Getpid(),
+		Started: time.Now(),
+		Expires: time.Now().Add(c.args.lockTTL),
+	}
+
+	if u, err := user.Current(); err == nil {
+		info.User = u.Username
+	}
+
+	data, err := json.Marshal(info)
+
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.stagingRootDir(), "cstu-"+unsafeLockChars.ReplaceAllString(c.lockKey(), "_")+".lock")
+
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+
+		if err == nil {
+			_, err = f.Write(data)
+			f.Close()
+
+			if err != nil {
+				os.Remove(path)
+				return fmt.Errorf("unable to write lock file %s: %s", path, err)
+			}
+
+			c.lockFile = path
+			c.Log.Debug().Msgf("Locked %s with %s", c.lockKey(), path)
+
+			// the journal is shared by runs of the same config, so only written once locked
+			if err := c.journal.save(); err != nil {
+				c.releaseHostLock()
+				return fmt.Errorf("unable to write journal %s: %s", c.journal.path, err)
+			}
+
+			return nil
+		}
+
+		if !os.IsExist(err) || attempt > 1 {
+			return fmt.Errorf("unable to create lock file %s: %s", path, err)
+		}
+
+		var held lockInfo
+
+		content, err := ioutil.ReadFile(path)
+
+		if os.IsNotExist(err) {
+			// released since, try to lock again
+			continue
+		}
+
+		if err == nil {
+			err = json.Unmarshal(content, &held)
+		}
+
+		switch {
+		case err != nil:
+			// a lock file is written in one go, so an unreadable one was left by a crash
+			c.Log.Warn().Msgf("Removing unreadable lock file %s: %s", path, err)
+		case c.args.forceUnlock:
+			c.Log.Warn().Msgf("Removing lock of %s held by %s as --force-unlock is set", c.lockKey(), held)
+		case held.stale(host):
+			c.Log.Warn().Msgf("Removing stale lock of %s held by %s", c.lockKey(), held)
+		default:
+			return fmt.Errorf("template %s is being updated by %s (lock file %s), use --force-unlock if that run is gone", c.lockKey(), held, path)
+		}
+
+		if err := takeOverLockFile(path, content, id); err != nil {
+			return err
+		}
+	}
+}
+
+// takeOverLockFile removes the stale lock file at path, which had content
+// when it was found stale. Another run may have taken it over and locked
+// again since, so the file is moved aside, which only one run can do, and
+// put back if it is no longer the stale one.
+func takeOverLockFile(path string, content []byte, id string) error {
+	aside := fmt.Sprintf("%s.%s.stale", path, id)
+
+	if err := os.Rename(path, aside); err != nil {
+		if os.IsNotExist(err) {
+			// removed by its run or another one taking it over, try to lock again
+			return nil
+		}
+
+		return fmt.Errorf("unable to remove lock file %s: %s", path, err)
+	}
+
+	moved, err := ioutil.ReadFile(aside)
+
+	if err == nil && bytes.Equal(moved, content) {
+		os.Remove(aside)
+		return nil
+	}
+
+	// a link fails rather than replace a lock taken in the meantime
+	if err := os.Link(aside, path); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("took over a fresh lock file by mistake, please move %s back to %s: %s", aside, path, err)
+	}
+
+	os.Remove(aside)
+
+	return fmt.Errorf("another run took over the stale lock file %s first", path)
+}
+
+// releaseHostLock removes the lock file of this run
+func (c *Command) releaseHostLock() {
+	if c.lockFile == "" {
+		return
+	}
+
+	if err := os.Remove(c.lockFile); err != nil && !os.IsNotExist(err) {
+		c.Log.Error().Msgf("Could not remove lock file %s, please remove manually: %s", c.lockFile, err)
+	}
+
+	c.lockFile = ""
+}
+
+// leaseValue is the lock tag value of this run, "<lock id>@<host>;<expiry>"
+func (c *Command) leaseValue() string {
+	host, _ := os.Hostname()
+
+	return fmt.Sprintf("%s@%s;%s", c.journal.LockID, host, time.Now().Add(c.args.lockTTL).UTC().Format(time.RFC3339))
+}
+
+// parseLease returns the lock id and expiry of a lock tag value
+func parseLease(value string) (string, time.Time) {
+	parts := strings.SplitN(value, ";", 2)
+	id := strings.SplitN(parts[0], "@", 2)[0]
+
+	if len(parts) != 2 {
+		return id, time.Time{}
+	}
+
+	expires, _ := time.Parse(time.RFC3339, parts[1])
+
+	return id, expires
+}
+
+// acquireLease tags the template this run replaces, so runs on other hosts
+// leave it alone. Expired leases and, with --force-unlock, those of other
+// runs are taken over.
+func (c *Command) acquireLease(cs *cloudstack.CloudStackClient, templID string) error {
+	tags, err := c.listTags(cs, templID)
+
+	if err != nil {
+		return fmt.Errorf("unable to check the lock of template %s: %s", templID, err)
+	}
+
+	if current, ok := tags[lockTagKey]; ok {
+		id, expires := parseLease(current)
+
+		switch {
+		case id == c.journal.LockID:
+			c.Log.Info().Msgf("Resuming with the lock of template %s", templID)
+
+			// it may be close to expiring, so it is renewed at the next chance
+			c.trackLease(templID, time.Now())
+
+			return nil
+		case c.args.forceUnlock:
+			c.Log.Warn().Msgf("Taking over the lock of template %s (%s) as --force-unlock is set", templID, current)
+		case time.Now().After(expires):
+			c.Log.Warn().Msgf("Taking over the expired lock of template %s (%s)", templID, current)
+		default:
+			return fmt.Errorf("template %s is being replaced by another run (%s=%s), use --force-unlock if that run is gone", templID, lockTagKey, current)
+		}
+
+		if err := c.deleteTags(cs, templID, map[string]string{lockTagKey: current}); err != nil {
+			return fmt.Errorf("unable to remove the lock of template %s: %s", templID, err)
+		}
+	}
+
+	value := c.leaseValue()
+
+	// a tag key exists once per resource, so of two runs creating it only one succeeds
+	if err := c.createTags(cs, templID, map[string]string{lockTagKey: value}); err != nil {
+		return fmt.Errorf("unable to lock template %s: %s", templID, err)
+	}
+
+	if err := c.checkLease(cs, templID); err != nil {
+		return err
+	}
+
+	c.trackLease(templID, time.Now().Add(c.args.lockTTL/2))
+
+	return nil
+}
+
+// trackLease remembers a lease of this run to be renewed from due on
+func (c *Command) trackLease(templID string, due time.Time) {
+	if c.leases == nil {
+		c.leases = make(map[string]time.Time)
+	}
+
+	c.leases[templID] = due
+}
+
+// renewLeases extends the leases of this run that are halfway to expiring.
+// It is called while the run waits on CloudStack, so a long upload does not
+// lose its leases to another run.
+func (c *Command) renewLeases(cs *cloudstack.CloudStackClient) error {
+	for templID, due := range c.leases {
+		if time.Now().Before(due) {
+			continue
+		}
+
+		if err := c.renewLease(cs, templID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renewLease replaces the lock tag of a template leased to this run with one
+// expiring a full lock ttl from now
+func (c *Command) renewLease(cs *cloudstack.CloudStackClient, templID string) error {
+	tags, err := c.listTags(cs, templID)
+
+	if err != nil {
+		return fmt.Errorf("unable to renew the lock of template %s: %s", templID, err)
+	}
+
+	current := tags[lockTagKey]
+
+	if id, _ := parseLease(current); id != c.journal.LockID {
+		return fmt.Errorf("template %s is no longer locked by this run (%s=%s)", templID, lockTagKey, current)
+	}
+
+	// tags can not be changed, only replaced
+	if err := c.deleteTags(cs, templID, map[string]string{lockTagKey: current}); err != nil {
+		return fmt.Errorf("unable to renew the lock of template %s: %s", templID, err)
+	}
+
+	if err := c.createTags(cs, templID, map[string]string{lockTagKey: c.leaseValue()}); err != nil {
+		return fmt.Errorf("unable to renew the lock of template %s: %s", templID, err)
+	}
+
+	c.Log.Debug().Msgf("Renewed the lock of template %s", templID)
+	c.trackLease(templID, time.Now().Add(c.args.lockTTL/2))
+
+	return nil
+}
+
+// checkLease makes sure this run still holds the lease of a template
+func (c *Command) checkLease(cs *cloudstack.CloudStackClient, templID string) error {
+	tags, err := c.listTags(cs, templID)
+
+	if err != nil {
+		return fmt.Errorf("unable to check the lock of template %s: %s", templID, err)
+	}
+
+	if id, _ := parseLease(tags[lockTagKey]); id != c.journal.LockID {
+		return fmt.Errorf("template %s is no longer locked by this run (%s=%s)", templID, lockTagKey, tags[lockTagKey])
+	}
+
+	return nil
+}
+
+// activeClaims returns the templates other than ownID claimed for key by a run
+// whose lease has not expired
+func activeClaims(templates []*cloudstack.Template, ownID, key string, now time.Time) []*cloudstack.Template {
+	var active []*cloudstack.Template
+
+	for _, t := range templates {
+		if t.Id == ownID || !hasTag(t, claimTagKey, key) {
+			continue
+		}
+
+		for _, tag := range t.Tags {
+			if _, expires := parseLease(tag.Value); tag.Key == lockTagKey && now.Before(expires) {
+				active = append(active, t)
+				break
+			}
+		}
+	}
+
+	return active
+}
+
+// claimTemplate leases the template this run registered when there was none
+// to replace. Without an old template to lease, runs on other hosts would
+// each register their own, so the new one is claimed for the name or alias
+// and a run that finds another run's claim deletes its template and gives way.
+// When both claim at once both give way, which is safe to retry.
+func (c *Command) claimTemplate(cs *cloudstack.CloudStackClient, entry *journalEntry) error {
+	if err := c.acquireLease(cs, entry.NewID); err != nil {
+		return err
+	}
+
+	tags, err := c.listTags(cs, entry.NewID)
+
+	if err != nil {
+		return fmt.Errorf("unable to check the claim of template %s: %s", entry.NewID, err)
+	}
+
+	if tags[claimTagKey] != c.lockKey() {
+		if err := c.createTags(cs, entry.NewID, map[string]string{claimTagKey: c.lockKey()}); err != nil {
+			return fmt.Errorf("unable to claim template %s: %s", entry.NewID, err)
+		}
+	}
+
+	if c.args.forceUnlock {
+		return nil
+	}
+
+	claimed, err := c.findTemplates(cs, func(p *cloudstack.ListTemplatesParams) {
+		p.SetZoneid(c.args.zoneID)
+		p.SetTags(map[string]string{claimTagKey: c.lockKey()})
+	})
+
+	if err != nil {
+		return fmt.Errorf("unable to look for templates claimed by other runs: %s", err)
+	}
+
+	others := activeClaims(claimed, entry.NewID, c.lockKey(), time.Now())
+
+	if len(others) == 0 {
+		return nil
+	}
+
+	var ids []string
+	for _, t := range others {
+		ids = append(ids, t.Id)
+	}
+
+	c.Log.Warn().Msgf("Template %s is also being uploaded by another run as %s, deleting template %s", c.lockKey(), strings.Join(ids, ", "), entry.NewID)
+
+	newID := entry.NewID
+	if c.deleteExistingTemplate(cs, newID) {
+		c.untrackCreated(entry)
+	}
+
+	// checked again by the next run, which then replaces the other run's template
+	entry.Checked = false
+	entry.Duplicates = nil
+	entry.NewID = ""
+	entry.URL = ""
+
+	if err := c.journal.record(entry); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("template %s is being uploaded by another run (%s), removed template %s of this run, rerun once the other run finished", c.lockKey(), strings.Join(ids, ", "), newID)
+}
+
+// releaseClaim removes the claim from a template once its run is over
+func (c *Command) releaseClaim(cs *cloudstack.CloudStackClient, templID string) {
+	if _, err := c.getTemplate(cs, templID); err != nil {
+		return
+	}
+
+	tags, err := c.listTags(cs, templID)
+
+	if err != nil {
+		c.Log.Error().Msgf("Unable to release the claim of template %s: %s", templID, err)
+		return
+	}
+
+	current, ok := tags[claimTagKey]
+
+	if !ok {
+		return
+	}
+
+	if err := c.deleteTags(cs, templID, map[string]string{claimTagKey: current}); err != nil {
+		c.Log.Error().Msgf("Unable to release the claim of template %s, remove its %s tag manually: %s", templID, claimTagKey, err)
+	}
+}
+
+// releaseLease removes this run's lease from a template that still exists
+func (c *Command) releaseLease(cs *cloudstack.CloudStackClient, templID string) {
+	delete(c.leases, templID)
+
+	if _, err := c.getTemplate(cs, templID); err != nil {
+		return
+	}
+
+	tags, err := c.listTags(cs, templID)
+
+	if err != nil {
+		c.Log.Error().Msgf("Unable to release the lock of template %s: %s", templID, err)
+		return
+	}
+
+	current, ok := tags[lockTagKey]
+
+	if id, _ := parseLease(current); !ok || id != c.journal.LockID {
+		return
+	}
+
+	if err := c.deleteTags(cs, templID, map[string]string{lockTagKey: current}); err != nil {
+		c.Log.Error().Msgf("Unable to release the lock of template %s, remove its %s tag manually: %s", templID, lockTagKey, err)
+	}
+}
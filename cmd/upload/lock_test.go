@@ -0,0 +1,145 @@
+package upload
+
+import (
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLease(t *testing.T) {
+	expiry := time.Date(2018, 4, 11, 16, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		id      string
+		expires time.Time
+	}{
+		{"lease", "a1b2c3d4@build1;2018-04-11T16:00:00Z", "a1b2c3d4", expiry},
+		{"offset", "a1b2c3d4@build1;2018-04-11T11:00:00-05:00", "a1b2c3d4", expiry},
+		{"no host", "a1b2c3d4;2018-04-11T16:00:00Z", "a1b2c3d4", expiry},
+		{"no expiry", "a1b2c3d4@build1", "a1b2c3d4", time.Time{}},
+		{"bad expiry", "a1b2c3d4@build1;tomorrow", "a1b2c3d4", time.Time{}},
+		{"empty", "", "", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, expires := parseLease(tt.value)
+
+			if id != tt.id || !expires.Equal(tt.expires) {
+				t.Errorf("parseLease(%q) = %q, %s, want %q, %s", tt.value, id, expires, tt.id, tt.expires)
+			}
+		})
+	}
+}
+
+func TestLeaseValue(t *testing.T) {
+	c := &Command{args: &Options{lockTTL: time.Hour}, journal: &journal{LockID: "a1b2c3d4"}}
+
+	id, expires := parseLease(c.leaseValue())
+
+	if id != "a1b2c3d4" {
+		t.Errorf("lease id = %q, want %q", id, "a1b2c3d4")
+	}
+
+	if d := time.Until(expires); d <= 58*time.Minute || d > time.Hour {
+		t.Errorf("lease expires in %s, want about %s", d, time.Hour)
+	}
+}
+
+func TestActiveClaims(t *testing.T) {
+	now := time.Date(2018, 4, 11, 12, 0, 0, 0, time.UTC)
+	valid := "a1b2@build1;" + now.Add(time.Hour).Format(time.RFC3339)
+	expired := "a1b2@build1;" + now.Add(-time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name      string
+		templates []*cloudstack.Template
+		want      []string
+	}{
+		{"none", nil, nil},
+		{"own template", []*cloudstack.Template{testTemplate("own", claimTagKey, "sles", lockTagKey, valid)}, nil},
+		{"other run", []*cloudstack.Template{testTemplate("other", claimTagKey, "sles", lockTagKey, valid)}, []string{"other"}},
+		{"expired lease", []*cloudstack.Template{testTemplate("other", claimTagKey, "sles", lockTagKey, expired)}, nil},
+		{"no lease", []*cloudstack.Template{testTemplate("other", claimTagKey, "sles")}, nil},
+		{"other key", []*cloudstack.Template{testTemplate("other", claimTagKey, "centos", lockTagKey, valid)}, nil},
+		{
+			"several",
+			[]*cloudstack.Template{
+				testTemplate("own", claimTagKey, "sles", lockTagKey, valid),
+				testTemplate("a", claimTagKey, "sles", lockTagKey, valid),
+				testTemplate("b", claimTagKey, "sles", lockTagKey, expired),
+				testTemplate("c", lockTagKey, valid, claimTagKey, "sles"),
+			},
+			[]string{"a", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range activeClaims(tt.templates, "own", "sles", now) {
+				got = append(got, c.Id)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("activeClaims() = %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("activeClaims() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTakeOverLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cstu-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cstu-sles.lock")
+	stale := []byte(`{"id":"a1b2c3d4","pid":1}`)
+	fresh := []byte(`{"id":"e5f6a7b8","pid":2}`)
+
+	if err := ioutil.WriteFile(path, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := takeOverLockFile(path, stale, "c9d0"); err != nil {
+		t.Fatalf("takeOverLockFile() of the stale lock = %s", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("stale lock file still exists: %v", err)
+	}
+
+	// taken over again by another run since it was found stale
+	if err := ioutil.WriteFile(path, fresh, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := takeOverLockFile(path, stale, "c9d0"); err == nil {
+		t.Error("takeOverLockFile() took over the lock of another run")
+	}
+
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != string(fresh) {
+		t.Errorf("lock file of the other run = %q, %v, want %q", content, err, fresh)
+	}
+
+	if err := takeOverLockFile(filepath.Join(dir, "cstu-gone.lock"), stale, "c9d0"); err != nil {
+		t.Errorf("takeOverLockFile() of a removed lock = %s", err)
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(dir, "*.stale")); len(left) > 0 {
+		t.Errorf("lock files left aside: %v", left)
+	}
+}
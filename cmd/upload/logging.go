@@ -0,0 +1,95 @@
+package upload
+
+import (
+	"github.com/myENA/cstu/cmd"
+	"os"
+)
+
+const (
+	phasePrepare  = "prepare"
+	phaseLookup   = "lookup"
+	phaseServe    = "serve"
+	phaseRegister = "register"
+	phaseWait     = "wait"
+	phaseSmoke    = "smoketest"
+	phaseTag      = "tag"
+	phaseCleanup  = "cleanup"
+)
+
+// setupLogging replaces the logger with one using the level and format flags
+func (c *Command) setupLogging() error {
+	if c.Redactor == nil {
+		c.Redactor = cmd.NewRedactor(os.Stderr)
+	}
+
+	level := c.args.logLevel
+
+	// --debug predates --log-level
+	if c.args.debug {
+		level = "debug"
+	}
+
+	logger, err := cmd.NewLogger(c.Redactor, c.args.logFormat, level)
+
+	if err != nil {
+		return err
+	}
+
+	c.Log = logger
+	c.baseLog = logger
+
+	return nil
+}
+
+// redactConfig masks every credential of the config in log output
+func (c *Command) redactConfig() {
+	for _, e := range c.args.CSEnvironments {
+		c.Redactor.AddSecret(e.APIKey)
+		c.Redactor.AddSecret(e.APISecret)
+
+		if e.ObjectStorage != nil {
+			c.Redactor.AddSecret(e.ObjectStorage.AccessKey)
+			c.Redactor.AddSecret(e.ObjectStorage.SecretKey)
+		}
+	}
+
+	// webhook urls, such as slack's, carry their credentials in the path
+	for _, h := range c.args.Webhooks {
+		c.Redactor.AddSecret(h.URL)
+	}
+}
+
+// setPhase tags the following log lines with the upload step being run
+func (c *Command) setPhase(phase string) {
+	c.phase = phase
+	c.scopeLog()
+}
+
+// setTemplateID tags the following log lines with the template being registered
+func (c *Command) setTemplateID(id string) {
+	c.templateID = id
+	c.scopeLog()
+}
+
+// scopeLog rebuilds the logger with the fields of the current target
+func (c *Command) scopeLog() {
+	ctx := c.baseLog.With().Str("template", c.args.Name)
+
+	if c.envName != "" {
+		ctx = ctx.Str("env", c.envName)
+	}
+
+	if c.zoneName != "" {
+		ctx = ctx.Str("zone", c.zoneName)
+	}
+
+	if c.templateID != "" {
+		ctx = ctx.Str("templateID", c.templateID)
+	}
+
+	if c.phase != "" {
+		ctx = ctx.Str("phase", c.phase)
+	}
+
+	c.Log = ctx.Logger()
+}
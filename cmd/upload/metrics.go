@@ -0,0 +1,133 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+var targetLabels = []string{"template", "environment", "zone"}
+
+// metrics describes the template rollout of a run, served on /metrics
+// and/or written in the node_exporter textfile collector format at exit
+type metrics struct {
+	registry    *prometheus.Registry
+	duration    *prometheus.GaugeVec
+	bytesServed *prometheus.GaugeVec
+	readyWait   *prometheus.GaugeVec
+	outcome     *prometheus.GaugeVec
+	apiCalls    *prometheus.CounterVec
+	apiErrors   *prometheus.CounterVec
+	lastRun     prometheus.Gauge
+	srv         *http.Server
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cstu_upload_duration_seconds",
+			Help: "Time taken to upload the template to a zone",
+		}, targetLabels),
+		bytesServed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cstu_upload_bytes_served",
+			Help: "Template bytes served to the secondary storage VMs of a zone",
+		}, targetLabels),
+		readyWait: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cstu_upload_ready_wait_seconds",
+			Help: "Time spent waiting for the registered template to become ready",
+		}, targetLabels),
+		outcome: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cstu_upload_outcome",
+			Help: "Final status of the upload to a zone, 1 for the status reached",
+		}, append(targetLabels, "status")),
+		apiCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cstu_api_calls_total",
+			Help: "CloudStack API calls made, by command",
+		}, append(targetLabels, "command")),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cstu_api_errors_total",
+			Help: "CloudStack API calls that failed, by command",
+		}, append(targetLabels, "command")),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cstu_last_run_timestamp_seconds",
+			Help: "Time the last upload run finished",
+		}),
+	}
+
+	m.registry.MustRegister(m.duration, m.bytesServed, m.readyWait, m.outcome, m.apiCalls, m.apiErrors, m.lastRun)
+
+	return m
+}
+
+// serve exposes /metrics on addr for the duration of the run. The address is
+// listened on right away, so a port in use is reported before the run starts.
+func (m *metrics) serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return fmt.Errorf("unable to serve metrics on %s: %s", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	m.srv = &http.Server{Handler: mux}
+
+	go m.srv.Serve(l)
+
+	return nil
+}
+
+func (m *metrics) stop() {
+	if m.srv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m.srv.Shutdown(ctx)
+}
+
+// apiCall counts a CloudStack API command made for a target
+func (m *metrics) apiCall(template, env, zone, command string, err error) {
+	m.apiCalls.WithLabelValues(template, env, zone, command).Inc()
+
+	if err != nil {
+		m.apiErrors.WithLabelValues(template, env, zone, command).Inc()
+	}
+}
+
+// observe records the outcome of a target
+func (m *metrics) observe(r *targetResult) {
+	m.duration.WithLabelValues(r.Template, r.Environment, r.Zone).Set(r.Duration)
+	m.readyWait.WithLabelValues(r.Template, r.Environment, r.Zone).Set(r.ReadyWait)
+
+	var served int64
+	for _, d := range r.Downloads {
+		served += d.Bytes
+	}
+
+	m.bytesServed.WithLabelValues(r.Template, r.Environment, r.Zone).Set(float64(served))
+
+	for _, status := range []string{resultUploaded, resultSkipped, resultFailed} {
+		value := 0.0
+		if status == r.Status {
+			value = 1
+		}
+
+		m.outcome.WithLabelValues(r.Template, r.Environment, r.Zone, status).Set(value)
+	}
+}
+
+// write saves every metric to a node_exporter textfile collector file
+func (m *metrics) write(path string) error {
+	m.lastRun.SetToCurrentTime()
+
+	return prometheus.WriteToTextfile(path, m.registry)
+}
@@ -0,0 +1,214 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// aliasTagKey is the tag marking the current template of an alias
+const aliasTagKey = "latest"
+
+// nameVars are the variables name and displayText can use, e.g.
+// "SLES-12.3-{{.Date}}-b{{.Build}}"
+type nameVars struct {
+	// build date and time, 20061231 and 150405
+	Date string
+	Time string
+	// git commit of the working directory, or from the CI environment
+	Commit string
+	// CI build number
+	Build string
+	Env   string
+	Zone  string
+	// --var key=value
+	Var map[string]string
+}
+
+// varFlags collects repeated --var key=value flags
+type varFlags map[string]string
+
+func (v varFlags) String() string {
+	var pairs []string
+	for k, value := range v {
+		pairs = append(pairs, k+"="+value)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (v varFlags) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("variables must be passed as key=value")
+	}
+
+	v[parts[0]] = parts[1]
+
+	return nil
+}
+
+// firstEnv returns the first environment variable of names that is set
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func gitCommit() string {
+	if commit := firstEnv("GIT_COMMIT", "CI_COMMIT_SHA", "GITHUB_SHA"); commit != "" {
+		if len(commit) > 8 {
+			return commit[:8]
+		}
+
+		return commit
+	}
+
+	out, err := exec.Command("git", "rev-parse", "--short=8", "HEAD").Output()
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// parseNames keeps the name and displayText templates of the config, and
+// sets the variables that stay the same for the whole run
+func (c *Command) parseNames() error {
+	var err error
+
+	templated := strings.Contains(c.args.Name, "{{")
+
+	if c.nameTmpl, err = template.New("name").Option("missingkey=error").Parse(c.args.Name); err != nil {
+		return fmt.Errorf("invalid name template: %s", err)
+	}
+
+	if c.displayTmpl, err = template.New("displayText").Option("missingkey=error").Parse(c.args.DisplayText); err != nil {
+		return fmt.Errorf("invalid displayText template: %s", err)
+	}
+
+	now := time.Now().UTC()
+
+	c.vars = nameVars{
+		Date:   now.Format("20060102"),
+		Time:   now.Format("150405"),
+		Commit: gitCommit(),
+		Build:  firstEnv("BUILD_NUMBER", "CI_PIPELINE_IID", "GITHUB_RUN_NUMBER"),
+		Var:    c.args.vars,
+	}
+
+	// staged files and objects are named once for the whole run
+	c.runName, err = renderName(c.nameTmpl, c.vars)
+
+	if err != nil {
+		return err
+	}
+
+	c.args.Name = c.runName
+
+	if templated && c.args.Alias == "" {
+		c.Log.Warn().Msg("name changes between runs but no alias is set, old templates will not be replaced")
+	}
+
+	return nil
+}
+
+// renderNames sets the name and displayText of the template for a zone. A
+// resumed zone keeps the names the previous run registered with.
+func (c *Command) renderNames(env, zone string) error {
+	entry := c.journal.entry(env, zone)
+
+	if entry.Name != "" {
+		c.args.Name = entry.Name
+		c.args.DisplayText = entry.DisplayText
+		return nil
+	}
+
+	vars := c.vars
+	vars.Env = env
+	vars.Zone = zone
+
+	name, err := renderName(c.nameTmpl, vars)
+
+	if err != nil {
+		return err
+	}
+
+	displayText, err := renderName(c.displayTmpl, vars)
+
+	if err != nil {
+		return err
+	}
+
+	c.args.Name = name
+	c.args.DisplayText = displayText
+
+	entry.Name = name
+	entry.DisplayText = displayText
+
+	return c.journal.record(entry)
+}
+
+func renderName(t *template.Template, vars nameVars) (string, error) {
+	var b bytes.Buffer
+
+	if err := t.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("unable to render %s: %s", t.Name(), err)
+	}
+
+	name := strings.TrimSpace(b.String())
+
+	if name == "" {
+		return "", fmt.Errorf("%s renders empty", t.Name())
+	}
+
+	return name, nil
+}
+
+// aliasTemplates returns the templates of the owner in a zone that are tagged
+// as the current version of the alias
+func (c *Command) aliasTemplates(cs *cloudstack.CloudStackClient, zoneID string) ([]*cloudstack.Template, error) {
+	templates, err := c.findTemplates(cs, func(p *cloudstack.ListTemplatesParams) {
+		p.SetZoneid(zoneID)
+		p.SetTags(map[string]string{aliasTagKey: c.args.Alias})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var current []*cloudstack.Template
+
+	for _, t := range templates {
+		if hasTag(t, aliasTagKey, c.args.Alias) {
+			current = append(current, t)
+		}
+	}
+
+	return current, nil
+}
+
+// releaseAlias removes the alias tag from a template that is no longer the
+// current version but could not be deleted
+func (c *Command) releaseAlias(cs *cloudstack.CloudStackClient, templID string) {
+	if c.args.Alias == "" {
+		return
+	}
+
+	c.Log.Info().Msgf("Moving alias %s away from template %s", c.args.Alias, templID)
+
+	if err := c.deleteTags(cs, templID, map[string]string{aliasTagKey: c.args.Alias}); err != nil {
+		c.Log.Error().Msgf("Unable to remove the %s tag from %s, please remove it manually: %s", aliasTagKey, templID, err)
+	}
+}
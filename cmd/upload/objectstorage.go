@@ -0,0 +1,96 @@
+package upload
+
+import (
+	"fmt"
+	"github.com/minio/minio-go"
+	"github.com/myENA/cstu/cmd"
+	"path"
+	"time"
+)
+
+const (
+	defaultObjectURLTTL = 6 * time.Hour
+
+	// presigned urls can not be valid for longer than a week
+	maxObjectURLTTL = 7 * 24 * time.Hour
+)
+
+// stagedObject is a template uploaded to object storage by this run
+type stagedObject struct {
+	client *minio.Client
+	bucket string
+	key    string
+	url    string
+}
+
+// uploadObject puts the template file in the environment's bucket and presigns
+// a url CloudStack can download it from
+func (c *Command) uploadObject(o *cmd.ObjectStorage) (*stagedObject, error) {
+	var err error
+
+	if o.Endpoint == "" || o.Bucket == "" {
+		return nil, fmt.Errorf("object storage needs an endpoint and a bucket")
+	}
+
+	ttl := defaultObjectURLTTL
+
+	if o.URLTTL != "" {
+		if ttl, err = time.ParseDuration(o.URLTTL); err != nil {
+			return nil, fmt.Errorf("invalid object storage urlTTL %s: %s", o.URLTTL, err)
+		}
+	}
+
+	if ttl <= 0 || ttl > maxObjectURLTTL {
+		return nil, fmt.Errorf("object storage urlTTL must be between 0 and %s", maxObjectURLTTL)
+	}
+
+	var client *minio.Client
+
+	if o.Region != "" {
+		client, err = minio.NewWithRegion(o.Endpoint, o.AccessKey, o.SecretKey, !o.DisableSSL, o.Region)
+	} else {
+		client, err = minio.New(o.Endpoint, o.AccessKey, o.SecretKey, !o.DisableSSL)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to create object storage client for %s: %s", o.Endpoint, err)
+	}
+
+	obj := &stagedObject{
+		client: client,
+		bucket: o.Bucket,
+		key:    path.Join(o.Prefix, fmt.Sprintf("%s-%d.qcow2", c.runName, time.Now().Unix())),
+	}
+
+	c.Log.Info().Msgf("Uploading %s to %s/%s/%s", c.args.TemplateFile, o.Endpoint, obj.bucket, obj.key)
+	size, err := client.FPutObjectWithContext(c.ctx, obj.bucket, obj.key, c.args.TemplateFile,
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to upload template to object storage: %s", err)
+	}
+
+	c.Log.Info().Msgf("Uploaded %d bytes to object storage", size)
+
+	u, err := client.PresignedGetObject(obj.bucket, obj.key, ttl, nil)
+
+	if err != nil {
+		c.removeObject(obj)
+		return nil, fmt.Errorf("unable to presign template url: %s", err)
+	}
+
+	obj.url = u.String()
+
+	c.Log.Info().Msgf("Template will be downloaded from object storage, url valid for %s", ttl)
+
+	return obj, nil
+}
+
+// removeObject deletes a template uploaded to object storage by this run
+func (c *Command) removeObject(obj *stagedObject) {
+	c.Log.Info().Msgf("Removing %s/%s from object storage", obj.bucket, obj.key)
+
+	if err := obj.client.RemoveObject(obj.bucket, obj.key); err != nil {
+		c.Log.Error().Msgf("Could not remove %s/%s from object storage, please remove manually: %s", obj.bucket, obj.key, err)
+	}
+}
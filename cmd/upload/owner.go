@@ -0,0 +1,241 @@
+package upload
+
+import (
+	"fmt"
+	"github.com/myENA/cstu/cmd"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"strings"
+)
+
+// templateOwner is the project, or account within a domain, templates are
+// looked up, registered, tagged and deleted in. Without either it is the
+// account of the api keys, which is looked up so its templates can be told
+// apart from those of other accounts an admin key also sees.
+type templateOwner struct {
+	projectID string
+	domainID  string
+	account   string
+
+	keyDomainID string
+	keyAccount  string
+}
+
+func (o templateOwner) String() string {
+	switch {
+	case o.projectID != "":
+		return "project " + o.projectID
+	case o.account != "":
+		return fmt.Sprintf("account %s in domain %s", o.account, o.domainID)
+	}
+
+	return fmt.Sprintf("api key account %s in domain %s", o.keyAccount, o.keyDomainID)
+}
+
+// owns reports whether a template belongs to the owner. Project templates
+// also name the account that registered them, so they never belong to an
+// account owner.
+func (o templateOwner) owns(t *cloudstack.Template) bool {
+	switch {
+	case o.projectID != "":
+		return t.Projectid == o.projectID
+	case o.account != "":
+		return t.Projectid == "" && t.Domainid == o.domainID && t.Account == o.account
+	}
+
+	return t.Projectid == "" && t.Domainid == o.keyDomainID && t.Account == o.keyAccount
+}
+
+// templateNotFound is returned when the owner has no template with an id
+type templateNotFound string
+
+func (id templateNotFound) Error() string {
+	return fmt.Sprintf("No match found for template %s", string(id))
+}
+
+// validateOwner checks the owner settings of an environment can be combined
+func validateOwner(e cmd.CloudstackEnvironment) error {
+	if e.Project != "" && e.Account != "" {
+		return fmt.Errorf("only one of project and account may be set for %s environment", e.Name)
+	}
+
+	if e.Account != "" && e.Domain == "" {
+		return fmt.Errorf("account needs a domain for %s environment", e.Name)
+	}
+
+	if e.Domain != "" && e.Account == "" && e.Project == "" {
+		return fmt.Errorf("domain needs an account or project for %s environment", e.Name)
+	}
+
+	return nil
+}
+
+// resolveOwner looks up the ids of the project, domain and account names of an environment
+func (c *Command) resolveOwner(cs *cloudstack.CloudStackClient, e cmd.CloudstackEnvironment) (templateOwner, error) {
+	var o templateOwner
+	var err error
+
+	if e.Domain != "" {
+		if o.domainID, err = c.domainID(cs, e.Domain); err != nil {
+			return o, err
+		}
+	}
+
+	if e.Account != "" {
+		if err := c.checkAccount(cs, e.Account, o.domainID); err != nil {
+			return o, err
+		}
+
+		o.account = e.Account
+	}
+
+	switch {
+	case e.Project != "":
+		if o.projectID, err = c.projectID(cs, e.Project, o.domainID); err != nil {
+			return o, err
+		}
+	case e.Account == "":
+		// projectID predates per environment owners
+		o.projectID = c.args.ProjectID
+	}
+
+	if o.projectID == "" && o.account == "" {
+		if o.keyAccount, o.keyDomainID, err = c.keyAccount(cs, e.APIKey); err != nil {
+			return o, err
+		}
+	}
+
+	return o, nil
+}
+
+// keyAccount looks up the account and domain id of the user an api key
+// belongs to
+func (c *Command) keyAccount(cs *cloudstack.CloudStackClient, apiKey string) (string, string, error) {
+	// without listall the own account is always among those listed
+	params := cs.Account.NewListAccountsParams()
+
+	var resp *cloudstack.ListAccountsResponse
+	err := c.call("listAccounts", func() error {
+		var err error
+		resp, err = cs.Account.ListAccounts(params)
+		return err
+	})
+
+	if err != nil {
+		return "", "", fmt.Errorf("unable to look up the account of the api key: %s", err)
+	}
+
+	for _, a := range resp.Accounts {
+		for _, u := range a.User {
+			if u.Apikey == apiKey {
+				return a.Name, a.Domainid, nil
+			}
+		}
+	}
+
+	return "", "", fmt.Errorf("unable to find the account of the api key, set the account and domain of the environment")
+}
+
+// domainID looks up a domain by name, or by path such as ROOT/customers/acme
+func (c *Command) domainID(cs *cloudstack.CloudStackClient, domain string) (string, error) {
+	name := domain
+	if i := strings.LastIndex(domain, "/"); i >= 0 {
+		name = domain[i+1:]
+	}
+
+	params := cs.Domain.NewListDomainsParams()
+	params.SetName(name)
+	params.SetListall(true)
+
+	var resp *cloudstack.ListDomainsResponse
+	err := c.call("listDomains", func() error {
+		var err error
+		resp, err = cs.Domain.ListDomains(params)
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	var ids []string
+
+	for _, d := range resp.Domains {
+		if d.Path == domain || (d.Name == domain && !strings.Contains(domain, "/")) {
+			ids = append(ids, d.Id)
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("domain %s not found", domain)
+	case 1:
+		return ids[0], nil
+	}
+
+	return "", fmt.Errorf("%d domains are named %s, use the full path such as ROOT/%s", len(ids), domain, domain)
+}
+
+// projectID looks up a project by name, within domainID when set
+func (c *Command) projectID(cs *cloudstack.CloudStackClient, project, domainID string) (string, error) {
+	params := cs.Project.NewListProjectsParams()
+	params.SetName(project)
+	params.SetListall(true)
+	if domainID != "" {
+		params.SetDomainid(domainID)
+	}
+
+	var resp *cloudstack.ListProjectsResponse
+	err := c.call("listProjects", func() error {
+		var err error
+		resp, err = cs.Project.ListProjects(params)
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	var ids []string
+
+	for _, p := range resp.Projects {
+		if p.Name == project {
+			ids = append(ids, p.Id)
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("project %s not found", project)
+	case 1:
+		return ids[0], nil
+	}
+
+	return "", fmt.Errorf("%d projects are named %s, set the domain to pick one", len(ids), project)
+}
+
+// checkAccount makes sure an account exists in a domain
+func (c *Command) checkAccount(cs *cloudstack.CloudStackClient, account, domainID string) error {
+	params := cs.Account.NewListAccountsParams()
+	params.SetName(account)
+	params.SetDomainid(domainID)
+	params.SetListall(true)
+
+	var resp *cloudstack.ListAccountsResponse
+	err := c.call("listAccounts", func() error {
+		var err error
+		resp, err = cs.Account.ListAccounts(params)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, a := range resp.Accounts {
+		if a.Name == account {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("account %s not found in domain %s", account, domainID)
+}
@@ -0,0 +1,36 @@
+package upload
+
+import (
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"testing"
+)
+
+func TestOwns(t *testing.T) {
+	project := templateOwner{projectID: "p1"}
+	account := templateOwner{domainID: "d1", account: "ops"}
+	key := templateOwner{keyDomainID: "d1", keyAccount: "ci"}
+
+	tests := []struct {
+		name  string
+		owner templateOwner
+		templ cloudstack.Template
+		want  bool
+	}{
+		{"project template", project, cloudstack.Template{Projectid: "p1", Account: "ci", Domainid: "d1"}, true},
+		{"other project", project, cloudstack.Template{Projectid: "p2", Account: "ci", Domainid: "d1"}, false},
+		{"account template", account, cloudstack.Template{Account: "ops", Domainid: "d1"}, true},
+		{"account in other domain", account, cloudstack.Template{Account: "ops", Domainid: "d2"}, false},
+		{"project template of the account", account, cloudstack.Template{Projectid: "p1", Account: "ops", Domainid: "d1"}, false},
+		{"key account template", key, cloudstack.Template{Account: "ci", Domainid: "d1"}, true},
+		{"other account", key, cloudstack.Template{Account: "admin", Domainid: "d1"}, false},
+		{"project template of the key account", key, cloudstack.Template{Projectid: "p1", Account: "ci", Domainid: "d1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.owner.owns(&tt.templ); got != tt.want {
+				t.Errorf("%s owns() = %t, want %t", tt.owner, got, tt.want)
+			}
+		})
+	}
+}
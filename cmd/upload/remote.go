@@ -0,0 +1,59 @@
+package upload
+
+import (
+	"fmt"
+	"strings"
+)
+
+// remoteTemplateURL returns the url of a template that is already hosted
+// elsewhere, either from templateURL or a templateFile given as a url
+func (c *Command) remoteTemplateURL() string {
+	if c.args.TemplateURL != "" {
+		return c.args.TemplateURL
+	}
+
+	if isHTTPURL(c.args.TemplateFile) {
+		return c.args.TemplateFile
+	}
+
+	return ""
+}
+
+func isHTTPURL(s string) bool {
+	s = strings.ToLower(s)
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// checkRemoteTemplate makes sure a hosted template can be downloaded before
+// it is registered anywhere
+func (c *Command) checkRemoteTemplate() error {
+	if !isHTTPURL(c.remote) {
+		return fmt.Errorf("template url %s must be an http or https url", c.remote)
+	}
+
+	c.Log.Info().Msgf("Checking template url %s", c.remote)
+	resp, err := headURL(c.ctx, c.remote)
+
+	if err != nil {
+		return fmt.Errorf("template url is not reachable: %s", err)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+
+	if strings.HasPrefix(contentType, "text/html") {
+		return fmt.Errorf("template url %s returned an html page instead of an image", c.remote)
+	}
+
+	size := "unknown size"
+
+	switch {
+	case resp.ContentLength == 0:
+		return fmt.Errorf("template url %s returned an empty file", c.remote)
+	case resp.ContentLength > 0:
+		size = fmt.Sprintf("%d bytes", resp.ContentLength)
+	}
+
+	c.Log.Info().Msgf("Template url is reachable: %s, content type %s", size, contentType)
+
+	return nil
+}
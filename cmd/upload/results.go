@@ -0,0 +1,118 @@
+package upload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	resultUploaded = "uploaded"
+	resultSkipped  = "skipped"
+	resultFailed   = "failed"
+)
+
+// targetResult is the outcome of uploading the template to one environment/zone
+type targetResult struct {
+	Environment string             `json:"environment"`
+	Zone        string             `json:"zone"`
+	Template    string             `json:"template"`
+	TemplateID  string             `json:"templateID,omitempty"`
+	ReplacedID  string             `json:"replacedID,omitempty"`
+	Status      string             `json:"status"`
+	Error       string             `json:"error,omitempty"`
+	Started     time.Time          `json:"started"`
+	Duration    float64            `json:"durationSeconds"`
+	ReadyWait   float64            `json:"readyWaitSeconds"`
+	Downloads   []downloadProgress `json:"downloads,omitempty"`
+	// autoscale VM profiles moved from the replaced template to the new one
+	AutoScaleProfiles []string `json:"autoScaleProfiles,omitempty"`
+	// what happened to the replaced template and its duplicates
+	Retired []retiredTemplate `json:"retired,omitempty"`
+}
+
+// newResult starts recording the outcome for an environment/zone
+func (c *Command) newResult(env, zone string) *targetResult {
+	r := &targetResult{
+		Environment: env,
+		Zone:        zone,
+		Template:    c.args.Name,
+		Started:     time.Now(),
+	}
+
+	c.results = append(c.results, r)
+
+	return r
+}
+
+// finish records the final status of a target
+func (r *targetResult) finish(status string, err error) {
+	r.Status = status
+	r.Duration = time.Since(r.Started).Seconds()
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// finishResult records the final status of a target and its metrics
+func (c *Command) finishResult(r *targetResult, status string, err error) {
+	r.finish(status, err)
+	c.metrics.observe(r)
+	c.notifyTarget(r)
+}
+
+// writeMetrics writes the metrics textfile once every target has finished
+func (c *Command) writeMetrics() {
+	if err := c.metrics.write(c.args.metricsFile); err != nil {
+		c.Log.Error().Msgf("Unable to write metrics to %s: %s", c.args.metricsFile, err)
+	}
+}
+
+// reportResults logs a summary of every target and writes the results file
+// if one was requested
+func (c *Command) reportResults() {
+	if len(c.results) == 0 {
+		return
+	}
+
+	c.Log.Info().Msg("Upload summary:")
+
+	for _, r := range c.results {
+		switch r.Status {
+		case resultFailed:
+			c.Log.Error().Msgf("  %s/%s: failed after %.0fs: %s", r.Environment, r.Zone, r.Duration, r.Error)
+		case resultSkipped:
+			c.Log.Info().Msgf("  %s/%s: already uploaded by a previous run", r.Environment, r.Zone)
+		default:
+			c.Log.Info().Msgf("  %s/%s: %s %s in %.0fs", r.Environment, r.Zone, r.Status, r.TemplateID, r.Duration)
+		}
+
+		for _, d := range r.Downloads {
+			c.Log.Info().Msgf("    %s", d)
+		}
+
+		for _, t := range r.Retired {
+			c.Log.Info().Msgf("    %s", t)
+		}
+
+		for _, p := range r.AutoScaleProfiles {
+			c.Log.Info().Msgf("    autoscale VM profile %s moved from %s to %s", p, r.ReplacedID, r.TemplateID)
+		}
+	}
+
+	if c.args.resultsFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(c.results, "", "  ")
+
+	if err != nil {
+		c.Log.Error().Msgf("Unable to encode results: %s", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(c.args.resultsFile, data, 0644); err != nil {
+		c.Log.Error().Msgf("Unable to write results to %s: %s", c.args.resultsFile, err)
+	}
+}
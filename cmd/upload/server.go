@@ -0,0 +1,458 @@
+package upload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/myENA/cstu/cmd"
+	"github.com/rs/zerolog"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templateServer is the builtin web server. Every registration downloads the
+// template under its own unguessable path token, which can be restricted to
+// the addresses of the secondary storage VMs of the zone.
+type templateServer struct {
+	log  zerolog.Logger
+	file string
+	name string
+	srv  *http.Server
+
+	// addresses of this host, always allowed so it can check itself
+	local map[string]bool
+
+	mu sync.RWMutex
+	// allowed addresses per token, nil allows any address
+	tokens map[string]map[string]bool
+	// download progress per token and client, kept after the token is revoked
+	downloads map[string]map[string]*downloadProgress
+	// phone home callbacks of smoke test VMs, closed once called
+	callbacks map[string]chan struct{}
+}
+
+// downloadProgress is how much of the template a client has fetched
+type downloadProgress struct {
+	Client    string    `json:"client"`
+	Bytes     int64     `json:"bytes"`
+	Size      int64     `json:"size"`
+	Rate      float64   `json:"bytesPerSecond"`
+	Completed bool      `json:"completed"`
+	Started   time.Time `json:"started"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func (d downloadProgress) percent() int64 {
+	if d.Size <= 0 {
+		return 0
+	}
+
+	if d.Bytes >= d.Size {
+		return 100
+	}
+
+	return d.Bytes * 100 / d.Size
+}
+
+func (d downloadProgress) String() string {
+	if d.Completed {
+		return fmt.Sprintf("%s fetched all %s at %s/s", d.Client, mib(d.Size), mib(int64(d.Rate)))
+	}
+
+	return fmt.Sprintf("%s fetched %s of %s (%d%%) at %s/s, last seen %s ago", d.Client, mib(d.Bytes), mib(d.Size),
+		d.percent(), mib(int64(d.Rate)), time.Since(d.LastSeen).Round(time.Second))
+}
+
+func mib(n int64) string {
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+}
+
+// countingWriter records the template bytes sent to a client
+type countingWriter struct {
+	http.ResponseWriter
+	s *templateServer
+	p *downloadProgress
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+
+	w.s.mu.Lock()
+	w.p.Bytes += int64(n)
+	w.p.LastSeen = time.Now()
+	if w.p.Bytes >= w.p.Size {
+		w.p.Completed = true
+	}
+	w.s.mu.Unlock()
+
+	return n, err
+}
+
+func newTemplateServer(log zerolog.Logger, file, name string, local []string) *templateServer {
+	s := &templateServer{
+		log:       log,
+		file:      file,
+		name:      name,
+		local:     make(map[string]bool),
+		tokens:    make(map[string]map[string]bool),
+		downloads: make(map[string]map[string]*downloadProgress),
+		callbacks: make(map[string]chan struct{}),
+	}
+
+	for _, a := range append(local, "127.0.0.1", "::1") {
+		s.local[normalizeIP(a)] = true
+	}
+
+	s.srv = &http.Server{Handler: s}
+
+	return s
+}
+
+// start serves on l in the background, using tls when certFile is set
+func (s *templateServer) start(l net.Listener, certFile, keyFile string) {
+	go func() {
+		var err error
+
+		if certFile != "" {
+			err = s.srv.ServeTLS(l, certFile, keyFile)
+		} else {
+			err = s.srv.Serve(l)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			s.log.Error().Msgf("Builtin web server stopped: %s", err)
+		}
+	}()
+}
+
+func (s *templateServer) stop(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// grant creates a new path token. Only the allowed addresses may use it, any
+// address when allowed is empty.
+func (s *templateServer) grant(allowed []string) (string, error) {
+	b := make([]byte, 24)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(b)
+
+	var addrs map[string]bool
+
+	if len(allowed) > 0 {
+		addrs = make(map[string]bool)
+		for _, a := range allowed {
+			addrs[normalizeIP(a)] = true
+		}
+	}
+
+	s.mu.Lock()
+	s.tokens[token] = addrs
+	s.mu.Unlock()
+
+	return token, nil
+}
+
+// revoke stops serving the template under token
+func (s *templateServer) revoke(token string) {
+	s.mu.Lock()
+	delete(s.tokens, token)
+	s.mu.Unlock()
+}
+
+func (s *templateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr := normalizeIP(host)
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+
+	if len(parts) == 2 && parts[0] == phoneHomePath {
+		s.phoneHome(w, r, addr, parts[1])
+		return
+	}
+
+	if len(parts) != 2 || parts[1] != s.name {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.RLock()
+	allowed, ok := s.tokens[parts[0]]
+	s.mu.RUnlock()
+
+	if !ok {
+		s.log.Debug().Msgf("Refused request from %s with an unknown or revoked token", addr)
+		http.NotFound(w, r)
+		return
+	}
+
+	if allowed != nil && !allowed[addr] && !s.local[addr] {
+		s.log.Info().Msgf("Refused template download from %s, it is not a secondary storage VM of the zone", addr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	f, err := os.Open(s.file)
+
+	if err != nil {
+		s.log.Error().Msgf("Unable to serve %s: %s", s.file, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		s.log.Error().Msgf("Unable to serve %s: %s", s.file, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, s.name, fi.ModTime(), f)
+		return
+	}
+
+	s.log.Debug().Msgf("Serving template to %s", addr)
+	http.ServeContent(&countingWriter{ResponseWriter: w, s: s, p: s.track(parts[0], addr, fi.Size(), r)}, r, s.name, fi.ModTime(), f)
+}
+
+// expectCall creates a phone home token and the channel closed once a VM calls it
+func (s *templateServer) expectCall() (string, <-chan struct{}, error) {
+	b := make([]byte, 24)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+
+	token := hex.EncodeToString(b)
+	called := make(chan struct{})
+
+	s.mu.Lock()
+	s.callbacks[token] = called
+	s.mu.Unlock()
+
+	return token, called, nil
+}
+
+func (s *templateServer) phoneHome(w http.ResponseWriter, r *http.Request, addr, token string) {
+	s.mu.Lock()
+	called, ok := s.callbacks[token]
+	delete(s.callbacks, token)
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.log.Info().Msgf("Smoke test VM %s phoned home", addr)
+	close(called)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// track returns the download progress of a client for token. A request for
+// the whole file starts counting again, a range request adds to it.
+func (s *templateServer) track(token, addr string, size int64, r *http.Request) *downloadProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients, ok := s.downloads[token]
+
+	if !ok {
+		clients = make(map[string]*downloadProgress)
+		s.downloads[token] = clients
+	}
+
+	now := time.Now()
+	p, ok := clients[addr]
+
+	if !ok || r.Header.Get("Range") == "" {
+		p = &downloadProgress{Client: addr, Size: size, Started: now}
+		clients[addr] = p
+	}
+
+	p.LastSeen = now
+
+	return p
+}
+
+// progress returns a snapshot of every download made with token
+func (s *templateServer) progress(token string) []downloadProgress {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []downloadProgress
+
+	for _, p := range s.downloads[token] {
+		d := *p
+
+		if elapsed := d.LastSeen.Sub(d.Started).Seconds(); elapsed > 0 {
+			d.Rate = float64(d.Bytes) / elapsed
+		}
+
+		out = append(out, d)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Client < out[j].Client })
+
+	return out
+}
+
+// normalizeIP makes IPv4 addresses compare equal whether or not they are IPv4-mapped
+func normalizeIP(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+
+	return addr
+}
+
+// startBuiltinServer serves the template file from this process on a free port
+func (c *Command) startBuiltinServer() error {
+	var certFile, keyFile string
+	var err error
+
+	if c.args.tls {
+		if certFile, keyFile, err = c.tlsFiles(); err != nil {
+			return err
+		}
+	}
+
+	l, err := net.Listen("tcp", ":0")
+
+	if err != nil {
+		return fmt.Errorf("unable to listen for the builtin web server: %s", err)
+	}
+
+	c.webPort = l.Addr().(*net.TCPAddr).Port
+	c.urlPath = fmt.Sprintf("%s://%s", c.scheme(), cmd.URLHost(c.args.HostIP, c.webPort))
+
+	// the server outlives the zone c.Log is scoped to
+	c.server = newTemplateServer(c.baseLog, c.args.TemplateFile, c.templateFileName(), []string{c.args.HostIP})
+	c.server.start(l, certFile, keyFile)
+
+	c.Log.Info().Msgf("Running builtin web server for upload: %s", c.urlPath)
+
+	if c.args.AdvertisedURL == "" {
+		return nil
+	}
+
+	// the probe comes from this host, which an address restriction may not see through NAT
+	if c.args.restrictSSVM {
+		c.Log.Info().Msgf("Not checking advertised url %s, downloads are restricted to secondary storage VMs", c.args.AdvertisedURL)
+		return nil
+	}
+
+	if err := c.grantToken(nil); err != nil {
+		return err
+	}
+
+	defer c.revokeToken()
+
+	return c.waitServed(c.ctx, "Advertised url", c.templateURL())
+}
+
+// grantToken creates the path token the next registration downloads the
+// template with, restricted to the zone's secondary storage VMs if needed
+func (c *Command) grantToken(cs *cloudstack.CloudStackClient) error {
+	if c.server == nil {
+		return nil
+	}
+
+	var allowed []string
+
+	if c.args.restrictSSVM && cs != nil {
+		addrs, err := c.ssvmAddresses(cs, c.args.zoneID)
+
+		if err != nil {
+			return err
+		}
+
+		c.Log.Info().Msgf("Only allowing secondary storage VM addresses %s to download the template", strings.Join(addrs, ", "))
+		allowed = addrs
+	}
+
+	token, err := c.server.grant(allowed)
+
+	if err != nil {
+		return fmt.Errorf("unable to create a download token: %s", err)
+	}
+
+	// anyone with the token can download the template unless restricted to the VMs
+	c.Redactor.AddSecret(token)
+	c.token = token
+
+	return nil
+}
+
+// revokeToken stops serving the template under the current token
+func (c *Command) revokeToken() {
+	if c.server == nil || c.token == "" {
+		return
+	}
+
+	c.server.revoke(c.token)
+	c.token = ""
+}
+
+// logDownloadProgress logs what the builtin server has sent for the current registration
+func (c *Command) logDownloadProgress() {
+	if c.server == nil || c.token == "" {
+		return
+	}
+
+	downloads := c.server.progress(c.token)
+
+	if len(downloads) == 0 {
+		c.Log.Info().Msg("No secondary storage VM has connected to download the template yet")
+		return
+	}
+
+	for _, d := range downloads {
+		c.Log.Info().Msgf("Download progress: %s", d)
+	}
+}
+
+// diagnoseDownload explains a failed registration from the serving side
+func diagnoseDownload(downloads []downloadProgress) string {
+	if len(downloads) == 0 {
+		return "no secondary storage VM ever connected to download the template"
+	}
+
+	var stalled []string
+
+	for _, d := range downloads {
+		if d.Completed {
+			return fmt.Sprintf("%s downloaded the whole template", d.Client)
+		}
+
+		stalled = append(stalled, fmt.Sprintf("%s stalled at %d%%", d.Client, d.percent()))
+	}
+
+	return "download " + strings.Join(stalled, ", ")
+}
@@ -0,0 +1,409 @@
+package upload
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/myENA/cstu/cmd"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	phoneHomePath           = "phonehome"
+	defaultSmokeTestTimeout = 10 * time.Minute
+	smokeTestPoll           = 10 * time.Second
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// smokeTestConfig is the smoke test of the current environment, which
+// overrides the one of the template
+func (c *Command) smokeTestConfig() *cmd.SmokeTest {
+	if c.env.SmokeTest != nil {
+		return c.env.SmokeTest
+	}
+
+	return c.args.SmokeTest
+}
+
+// smokeTest deploys a VM from the new template and waits for it to run and,
+// if configured, to answer on a tcp port or phone home. The VM is always
+// destroyed again.
+func (c *Command) smokeTest(cs *cloudstack.CloudStackClient, templateID string) error {
+	st := c.smokeTestConfig()
+
+	timeout, err := parseTimeout(st.Timeout, defaultSmokeTestTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+
+	offeringID, err := c.serviceOfferingID(cs, st.ServiceOffering)
+
+	if err != nil {
+		return err
+	}
+
+	params := cs.VirtualMachine.NewDeployVirtualMachineParams(offeringID, templateID, c.args.zoneID)
+
+	if st.Network != "" {
+		networkID, err := c.networkID(cs, st.Network)
+
+		if err != nil {
+			return err
+		}
+
+		params.SetNetworkids([]string{networkID})
+	}
+
+	name := fmt.Sprintf("cstu-smoke-%d", time.Now().Unix())
+	params.SetName(name)
+	params.SetDisplayname(fmt.Sprintf("cstu smoke test of %s", c.args.Name))
+
+	if c.owner.projectID != "" {
+		params.SetProjectid(c.owner.projectID)
+	}
+	if c.owner.account != "" {
+		params.SetDomainid(c.owner.domainID)
+		params.SetAccount(c.owner.account)
+	}
+
+	var called <-chan struct{}
+
+	if st.PhoneHome {
+		// a resumed run or one uploading through object storage has not started it yet
+		if c.server == nil {
+			if err := c.startBuiltinServer(); err != nil {
+				return fmt.Errorf("unable to start the builtin web server for the smoke test phone home: %s", err)
+			}
+
+			c.serving = true
+		}
+
+		var token string
+		if token, called, err = c.server.expectCall(); err != nil {
+			return err
+		}
+
+		c.Redactor.AddSecret(token)
+		params.SetUserdata(base64.StdEncoding.EncodeToString([]byte(phoneHomeScript(c.phoneHomeURL(token)))))
+	}
+
+	c.Log.Info().Msgf("Deploying smoke test VM %s from template %s", name, templateID)
+
+	// the deploy job must not outlast the smoke test
+	if deadline, ok := ctx.Deadline(); ok {
+		cs.AsyncTimeout(int64(time.Until(deadline).Seconds()) + 1)
+		defer cs.AsyncTimeout(int64(c.asyncTimeout.Seconds()))
+	}
+
+	// the deploy response and a listed VM are different types, keep what is needed of either
+	var vmID, vmAddr, jobID string
+	err = c.callChecked("deployVirtualMachine", func() error {
+		vm, err := cs.VirtualMachine.DeployVirtualMachine(params)
+		// a deploy job that timed out still names the VM it created
+		if vm != nil && vm.Id != "" {
+			vmID = vm.Id
+			jobID = vm.JobID
+			if len(vm.Nic) > 0 {
+				vmAddr = vm.Nic[0].Ipaddress
+			}
+		}
+		return err
+	}, func() (bool, error) {
+		// the name is unique to this attempt, so a VM with it was deployed by it
+		found, err := c.findVirtualMachine(cs, name)
+
+		if found != nil {
+			vmID = found.Id
+			if len(found.Nic) > 0 {
+				vmAddr = found.Nic[0].Ipaddress
+			}
+		}
+
+		return found != nil, err
+	})
+
+	c.audit("deployVirtualMachine", templateID, vmID, jobID, map[string]string{"name": name}, err)
+
+	// a deploy that failed or timed out may still leave a VM behind, in Error state or starting
+	if vmID == "" && err != nil {
+		if found, findErr := c.findVirtualMachine(cs, name); findErr != nil {
+			c.Log.Error().Msgf("Unable to look for smoke test VM %s after the failed deploy, please check for it manually: %s", name, findErr)
+		} else if found != nil {
+			vmID = found.Id
+		}
+	}
+
+	if vmID != "" {
+		defer c.destroySmokeTestVM(cs, vmID)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to deploy smoke test VM: %s", err)
+	}
+
+	if err := c.waitRunning(ctx, cs, vmID); err != nil {
+		return err
+	}
+
+	if st.Port != 0 {
+		if vmAddr == "" {
+			return fmt.Errorf("smoke test VM %s has no address to check port %d on", vmID, st.Port)
+		}
+
+		if err := waitPort(ctx, vmAddr, st.Port); err != nil {
+			return fmt.Errorf("smoke test VM %s never accepted connections on port %d: %s", vmID, st.Port, err)
+		}
+
+		c.Log.Info().Msgf("Smoke test VM accepts connections on port %d", st.Port)
+	}
+
+	if called != nil {
+		c.Log.Info().Msg("Waiting for the smoke test VM to phone home")
+
+		select {
+		case <-called:
+		case <-ctx.Done():
+			return fmt.Errorf("smoke test VM %s never phoned home: %s", vmID, ctx.Err())
+		}
+	}
+
+	c.Log.Info().Msgf("Smoke test of template %s passed", templateID)
+
+	return nil
+}
+
+// phoneHomeURL is the url smoke test VMs call back on once booted
+func (c *Command) phoneHomeURL(token string) string {
+	base := c.urlPath
+
+	if c.args.AdvertisedURL != "" {
+		base = strings.TrimRight(c.args.AdvertisedURL, "/")
+	}
+
+	return fmt.Sprintf("%s/%s/%s", base, phoneHomePath, token)
+}
+
+// phoneHomeScript is the user data calling url once cloud-init ran
+func phoneHomeScript(url string) string {
+	return fmt.Sprintf("#!/bin/sh\ncurl -fsSk %[1]s || wget -q -O /dev/null --no-check-certificate %[1]s\n", url)
+}
+
+// serviceOfferingID resolves a service offering name, ids are used as is
+func (c *Command) serviceOfferingID(cs *cloudstack.CloudStackClient, offering string) (string, error) {
+	if uuidPattern.MatchString(offering) {
+		return offering, nil
+	}
+
+	var id string
+	err := c.call("listServiceOfferings", func() error {
+		var err error
+		id, _, err = cs.ServiceOffering.GetServiceOfferingID(offering)
+		return err
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("unable to find service offering %s: %s", offering, err)
+	}
+
+	return id, nil
+}
+
+// networkID resolves a network name in the current zone, ids are used as is
+func (c *Command) networkID(cs *cloudstack.CloudStackClient, network string) (string, error) {
+	if uuidPattern.MatchString(network) {
+		return network, nil
+	}
+
+	params := cs.Network.NewListNetworksParams()
+	params.SetZoneid(c.args.zoneID)
+	params.SetKeyword(network)
+	if c.owner.projectID != "" {
+		params.SetProjectid(c.owner.projectID)
+	}
+	if c.owner.account != "" {
+		params.SetDomainid(c.owner.domainID)
+		params.SetAccount(c.owner.account)
+	}
+
+	var resp *cloudstack.ListNetworksResponse
+	err := c.call("listNetworks", func() error {
+		var err error
+		resp, err = cs.Network.ListNetworks(params)
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, n := range resp.Networks {
+		if n.Name == network {
+			return n.Id, nil
+		}
+	}
+
+	return "", fmt.Errorf("network %s not found in zone %s", network, c.zoneName)
+}
+
+// findVirtualMachine looks up a VM of the owner by name in the current zone
+func (c *Command) findVirtualMachine(cs *cloudstack.CloudStackClient, name string) (*cloudstack.VirtualMachine, error) {
+	params := cs.VirtualMachine.NewListVirtualMachinesParams()
+	params.SetName(name)
+	params.SetZoneid(c.args.zoneID)
+	if c.owner.projectID != "" {
+		params.SetProjectid(c.owner.projectID)
+	}
+	if c.owner.account != "" {
+		params.SetDomainid(c.owner.domainID)
+		params.SetAccount(c.owner.account)
+	}
+
+	var resp *cloudstack.ListVirtualMachinesResponse
+	err := c.call("listVirtualMachines", func() error {
+		var err error
+		resp, err = cs.VirtualMachine.ListVirtualMachines(params)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vm := range resp.VirtualMachines {
+		if vm.Name == name {
+			return vm, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// waitRunning polls a VM until it is running
+func (c *Command) waitRunning(ctx context.Context, cs *cloudstack.CloudStackClient, id string) error {
+	params := cs.VirtualMachine.NewListVirtualMachinesParams()
+	params.SetId(id)
+	if c.owner.projectID != "" {
+		params.SetProjectid(c.owner.projectID)
+	}
+
+	for {
+		var resp *cloudstack.ListVirtualMachinesResponse
+		err := c.call("listVirtualMachines", func() error {
+			var err error
+			resp, err = cs.VirtualMachine.ListVirtualMachines(params)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if len(resp.VirtualMachines) == 0 {
+			return fmt.Errorf("smoke test VM %s disappeared", id)
+		}
+
+		state := resp.VirtualMachines[0].State
+
+		switch state {
+		case "Running":
+			c.Log.Info().Msgf("Smoke test VM %s is running", id)
+			return nil
+		case "Error", "Stopped", "Destroyed", "Expunging":
+			return fmt.Errorf("smoke test VM %s is %s", id, state)
+		}
+
+		c.Log.Info().Msgf("Waiting for smoke test VM %s, state: %s", id, state)
+
+		if err := sleepContext(ctx, smokeTestPoll); err != nil {
+			return fmt.Errorf("smoke test VM %s never reached Running: %s", id, err)
+		}
+
+		if err := c.renewLeases(cs); err != nil {
+			return err
+		}
+	}
+}
+
+// waitPort dials addr:port until it accepts a connection
+func waitPort(ctx context.Context, addr string, port int) error {
+	target := net.JoinHostPort(addr, strconv.Itoa(port))
+	var d net.Dialer
+
+	for {
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := d.DialContext(dialCtx, "tcp", target)
+		cancel()
+
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		if err := sleepContext(ctx, smokeTestPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// destroySmokeTestVM expunges the smoke test VM, also when the run was
+// interrupted. Keys of users that may not expunge destroy it only, leaving
+// CloudStack to expunge it later.
+func (c *Command) destroySmokeTestVM(cs *cloudstack.CloudStackClient, id string) {
+	c.Log.Info().Msgf("Destroying smoke test VM %s", id)
+
+	err := c.destroyVM(cs, id, true)
+
+	if permissionDenied(err) {
+		c.Log.Warn().Msgf("Not allowed to expunge smoke test VM %s, destroying it only: %s", id, err)
+		err = c.destroyVM(cs, id, false)
+	}
+
+	if err != nil {
+		c.Log.Error().Msgf("Unable to destroy smoke test VM %s, please remove it manually: %s", id, err)
+	}
+}
+
+// destroyVM destroys a VM, expunging it right away if asked to
+func (c *Command) destroyVM(cs *cloudstack.CloudStackClient, id string, expunge bool) error {
+	params := cs.VirtualMachine.NewDestroyVirtualMachineParams(id)
+	params.SetExpunge(expunge)
+
+	resp, err := cs.VirtualMachine.DestroyVirtualMachine(params)
+	c.metrics.apiCall(c.args.Name, c.envName, c.zoneName, "destroyVirtualMachine", err)
+
+	jobID := ""
+	if resp != nil {
+		jobID = resp.JobID
+	}
+
+	c.audit("destroyVirtualMachine", c.templateID, id, jobID, map[string]string{"expunge": strconv.FormatBool(expunge)}, err)
+
+	return err
+}
+
+// smokeTests returns every smoke test of the config
+func (c *Command) smokeTests() []*cmd.SmokeTest {
+	var tests []*cmd.SmokeTest
+
+	if c.args.SmokeTest != nil {
+		tests = append(tests, c.args.SmokeTest)
+	}
+
+	for _, e := range c.args.CSEnvironments {
+		if e.SmokeTest != nil {
+			tests = append(tests, e.SmokeTest)
+		}
+	}
+
+	return tests
+}
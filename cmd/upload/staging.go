@@ -0,0 +1,163 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	stageSymlink  = "symlink"
+	stageHardlink = "hardlink"
+	stageCopy     = "copy"
+)
+
+// templateFileName is the name the template is served under, the same for
+// every zone of the run
+func (c *Command) templateFileName() string {
+	return c.runName + ".qcow2"
+}
+
+// servedPath is the path of the staged template relative to the web root
+func (c *Command) servedPath() string {
+	// the builtin server serves the template file itself under the token of the registration
+	if c.args.builtin {
+		return path.Join(c.token, c.templateFileName())
+	}
+
+	// the system httpd serves all of webPath, the container only this run's staging directory
+	if c.args.system {
+		return path.Join(filepath.Base(c.stagingDir), c.templateFileName())
+	}
+
+	return c.templateFileName()
+}
+
+// templateURL is the url CloudStack downloads the template from
+func (c *Command) templateURL() string {
+	if c.remote != "" {
+		return c.remote
+	}
+
+	if c.objectURL != "" {
+		return c.objectURL
+	}
+
+	// behind NAT or a load balancer CloudStack fetches from a different address than the one served on
+	if c.args.AdvertisedURL != "" {
+		return fmt.Sprintf("%s/%s", strings.TrimRight(c.args.AdvertisedURL, "/"), c.servedPath())
+	}
+
+	return c.localTemplateURL()
+}
+
+// localTemplateURL is the url the web server serves the template on
+func (c *Command) localTemplateURL() string {
+	return fmt.Sprintf("%s/%s", c.urlPath, c.servedPath())
+}
+
+// stagingRootDir is the directory staging directories are created in
+func (c *Command) stagingRootDir() string {
+	if c.args.stagingRoot != "" {
+		return c.args.stagingRoot
+	}
+
+	if c.args.system {
+		return webPath
+	}
+
+	return os.TempDir()
+}
+
+// stageTemplate creates a staging directory private to this run and places
+// the template file in it using the configured staging mode
+func (c *Command) stageTemplate() error {
+	root := c.stagingRootDir()
+
+	src, err := filepath.Abs(c.args.TemplateFile)
+
+	if err != nil {
+		return err
+	}
+
+	c.args.TemplateFile = src
+
+	dir, err := ioutil.TempDir(root, "cstu-")
+
+	if err != nil {
+		return fmt.Errorf("unable to create staging directory in %s: %s", root, err)
+	}
+
+	c.stagingDir = dir
+
+	// the web server does not run as this user, so it needs to be able to read the directory
+	if err := os.Chmod(dir, 0755); err != nil {
+		c.removeStaging()
+		return err
+	}
+
+	dst := filepath.Join(dir, c.templateFileName())
+
+	c.Log.Info().Msgf("Staging %s in %s (%s)", src, dir, c.args.stagingMode)
+
+	switch c.args.stagingMode {
+	case stageSymlink:
+		err = os.Symlink(src, dst)
+	case stageHardlink:
+		err = os.Link(src, dst)
+	case stageCopy:
+		err = copyFile(src, dst)
+	default:
+		err = fmt.Errorf("unknown staging mode %s, use %s, %s or %s", c.args.stagingMode, stageSymlink, stageHardlink, stageCopy)
+	}
+
+	if err != nil {
+		c.removeStaging()
+		return fmt.Errorf("unable to stage %s: %s", src, err)
+	}
+
+	return nil
+}
+
+// removeStaging deletes the staging directory created by this run. Links are
+// removed, never the files they point to.
+func (c *Command) removeStaging() {
+	if c.stagingDir == "" {
+		return
+	}
+
+	c.Log.Info().Msgf("Removing staging directory %s", c.stagingDir)
+	if err := os.RemoveAll(c.stagingDir); err != nil {
+		c.Log.Error().Msgf("Could not remove %s, please remove manually: %s", c.stagingDir, err)
+		return
+	}
+
+	c.stagingDir = ""
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,169 @@
+package upload
+
+import (
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"sort"
+	"strings"
+)
+
+// managedTagKey lists the keys of the tags cstu set on a template, so tags
+// dropped from the config are removed again
+const managedTagKey = "cstu-managed"
+
+// managedTags are the tags cstu sets on every new template: resourceTags
+// overridden by --tag, the replace tag and the alias
+func (c *Command) managedTags() map[string]string {
+	tags := make(map[string]string)
+
+	for k, v := range c.args.ResourceTags {
+		tags[k] = v
+	}
+
+	for k, v := range c.args.tags {
+		tags[k] = v
+	}
+
+	if c.args.ReplaceTag != "" {
+		k, v := c.replaceTag()
+		tags[k] = v
+	}
+
+	if c.args.Alias != "" {
+		tags[aliasTagKey] = c.args.Alias
+	}
+
+	return tags
+}
+
+func splitKeys(s string) map[string]bool {
+	keys := make(map[string]bool)
+
+	for _, k := range strings.Split(s, ",") {
+		if k != "" {
+			keys[k] = true
+		}
+	}
+
+	return keys
+}
+
+// desiredTags are the tags the new template should end up with. With
+// carryOverTags, the tags of the replaced template that cstu did not set are
+// kept.
+func (c *Command) desiredTags(cs *cloudstack.CloudStackClient, existingID string) (map[string]string, error) {
+	desired := make(map[string]string)
+
+	if c.args.CarryOverTags && existingID != "" {
+		old, err := c.listTags(cs, existingID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		oldManaged := splitKeys(old[managedTagKey])
+
+		for k, v := range old {
+			if k == managedTagKey || k == aliasTagKey || k == lockTagKey || k == claimTagKey || oldManaged[k] {
+				continue
+			}
+
+			desired[k] = v
+		}
+	}
+
+	managed := c.managedTags()
+
+	var keys []string
+	for k, v := range managed {
+		desired[k] = v
+		keys = append(keys, k)
+	}
+
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		desired[managedTagKey] = strings.Join(keys, ",")
+	}
+
+	return desired, nil
+}
+
+// syncTags reconciles the tags of a template: missing tags are added, changed
+// values replaced and tags cstu set before but no longer wants removed.
+// Tags set by others are left alone.
+func (c *Command) syncTags(cs *cloudstack.CloudStackClient, templID, existingID string) error {
+	desired, err := c.desiredTags(cs, existingID)
+
+	if err != nil {
+		return err
+	}
+
+	current, err := c.listTags(cs, templID)
+
+	if err != nil {
+		return err
+	}
+
+	remove, create := tagChanges(current, desired)
+
+	if len(remove) == 0 && len(create) == 0 {
+		return nil
+	}
+
+	if len(remove) > 0 {
+		c.Log.Info().Msgf("Removing tags %s from template %s", tagKeys(remove), templID)
+		if err := c.deleteTags(cs, templID, remove); err != nil {
+			return err
+		}
+	}
+
+	if len(create) > 0 {
+		c.Log.Info().Msgf("Setting tags %s on template %s", tagKeys(create), templID)
+		if err := c.createTags(cs, templID, create); err != nil {
+			return err
+		}
+	}
+
+	c.Log.Info().Msgf("Successfully synced resource tags for: %s", templID)
+
+	return nil
+}
+
+// tagChanges returns the tags to remove from and create on a template to get
+// from its current tags to the desired ones
+func tagChanges(current, desired map[string]string) (map[string]string, map[string]string) {
+	previouslyManaged := splitKeys(current[managedTagKey])
+	previouslyManaged[managedTagKey] = true
+
+	remove := make(map[string]string)
+	create := make(map[string]string)
+
+	for k, v := range current {
+		if want, ok := desired[k]; ok {
+			// tags can not be updated, only deleted and created again
+			if want != v {
+				remove[k] = v
+			}
+		} else if previouslyManaged[k] {
+			remove[k] = v
+		}
+	}
+
+	for k, v := range desired {
+		if have, ok := current[k]; !ok || have != v {
+			create[k] = v
+		}
+	}
+
+	return remove, create
+}
+
+func tagKeys(tags map[string]string) string {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return strings.Join(keys, ", ")
+}
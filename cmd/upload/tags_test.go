@@ -0,0 +1,97 @@
+package upload
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		current map[string]string
+		desired map[string]string
+		remove  map[string]string
+		create  map[string]string
+	}{
+		{
+			name:    "new template",
+			current: map[string]string{},
+			desired: map[string]string{"os": "sles", managedTagKey: "os"},
+			remove:  map[string]string{},
+			create:  map[string]string{"os": "sles", managedTagKey: "os"},
+		},
+		{
+			name:    "in sync",
+			current: map[string]string{"os": "sles", managedTagKey: "os"},
+			desired: map[string]string{"os": "sles", managedTagKey: "os"},
+			remove:  map[string]string{},
+			create:  map[string]string{},
+		},
+		{
+			name:    "changed value",
+			current: map[string]string{"os": "sles12", managedTagKey: "os"},
+			desired: map[string]string{"os": "sles15", managedTagKey: "os"},
+			remove:  map[string]string{"os": "sles12"},
+			create:  map[string]string{"os": "sles15"},
+		},
+		{
+			name:    "dropped from the config",
+			current: map[string]string{"os": "sles", "team": "ops", managedTagKey: "os,team"},
+			desired: map[string]string{"os": "sles", managedTagKey: "os"},
+			remove:  map[string]string{"team": "ops", managedTagKey: "os,team"},
+			create:  map[string]string{managedTagKey: "os"},
+		},
+		{
+			name:    "nothing managed any more",
+			current: map[string]string{"os": "sles", managedTagKey: "os"},
+			desired: map[string]string{},
+			remove:  map[string]string{"os": "sles", managedTagKey: "os"},
+			create:  map[string]string{},
+		},
+		{
+			name:    "tags of others and locks kept",
+			current: map[string]string{"owner": "alice", lockTagKey: "a1b2@build1;2018-04-11T12:00:00Z", managedTagKey: "os"},
+			desired: map[string]string{"os": "sles", managedTagKey: "os"},
+			remove:  map[string]string{},
+			create:  map[string]string{"os": "sles"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remove, create := tagChanges(tt.current, tt.desired)
+
+			if !reflect.DeepEqual(remove, tt.remove) {
+				t.Errorf("tagChanges() remove = %v, want %v", remove, tt.remove)
+			}
+
+			if !reflect.DeepEqual(create, tt.create) {
+				t.Errorf("tagChanges() create = %v, want %v", create, tt.create)
+			}
+		})
+	}
+}
+
+func TestSplitKeys(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]bool
+	}{
+		{"", map[string]bool{}},
+		{"os", map[string]bool{"os": true}},
+		{"os,team", map[string]bool{"os": true, "team": true}},
+		{",os,,team,", map[string]bool{"os": true, "team": true}},
+	}
+
+	for _, tt := range tests {
+		if got := splitKeys(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitKeys(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTagKeys(t *testing.T) {
+	if got := tagKeys(map[string]string{"team": "ops", "os": "sles", "latest": "sles"}); got != "latest, os, team" {
+		t.Errorf("tagKeys() = %q, want %q", got, "latest, os, team")
+	}
+}
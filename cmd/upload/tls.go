@@ -0,0 +1,185 @@
+package upload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// httpdTLSCmd enables mod_ssl and the default ssl vhost of the httpd:alpine image
+	httpdTLSCmd = `sed -i -e 's/^#\(Include .*httpd-ssl.conf\)/\1/' ` +
+		`-e 's/^#\(LoadModule .*mod_ssl.so\)/\1/' ` +
+		`-e 's/^#\(LoadModule .*mod_socache_shmcb.so\)/\1/' conf/httpd.conf && exec httpd-foreground`
+
+	generatedCertFile = "cstu.crt"
+	generatedKeyFile  = "cstu.key"
+	generatedCertLife = 365 * 24 * time.Hour
+)
+
+// scheme is the url scheme templates are served with
+func (c *Command) scheme() string {
+	if c.args.tls {
+		return "https"
+	}
+
+	return "http"
+}
+
+// tlsFiles returns the certificate and key the web server uses. Without a
+// configured pair, a self-signed certificate for the host address is
+// generated once in the tls directory and reused, so CloudStack only has to
+// trust it once.
+func (c *Command) tlsFiles() (string, string, error) {
+	if c.args.tlsCert != "" || c.args.tlsKey != "" {
+		if c.args.tlsCert == "" || c.args.tlsKey == "" {
+			return "", "", fmt.Errorf("--tls-cert and --tls-key must be passed together")
+		}
+
+		if _, err := tls.LoadX509KeyPair(c.args.tlsCert, c.args.tlsKey); err != nil {
+			return "", "", fmt.Errorf("unable to load tls certificate: %s", err)
+		}
+
+		// the files are bind mounted into the web container, which requires absolute paths
+		certFile, err := filepath.Abs(c.args.tlsCert)
+
+		if err != nil {
+			return "", "", err
+		}
+
+		keyFile, err := filepath.Abs(c.args.tlsKey)
+
+		return certFile, keyFile, err
+	}
+
+	dir := c.args.tlsDir
+
+	if dir == "" {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return "", "", err
+		}
+
+		dir = filepath.Join(home, ".cstu", "tls")
+	}
+
+	certFile := filepath.Join(dir, generatedCertFile)
+	keyFile := filepath.Join(dir, generatedKeyFile)
+
+	hosts := []string{c.args.HostIP}
+
+	if c.args.AdvertisedURL != "" {
+		if u, err := url.Parse(c.args.AdvertisedURL); err == nil && u.Hostname() != c.args.HostIP {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+
+	if certValidFor(certFile, keyFile, hosts) {
+		return certFile, keyFile, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	c.Log.Info().Msgf("Generating a self-signed certificate for %s in %s, CloudStack must trust it before it can download templates", strings.Join(hosts, ", "), certFile)
+	if err := generateCertificate(certFile, keyFile, hosts); err != nil {
+		return "", "", fmt.Errorf("unable to generate tls certificate: %s", err)
+	}
+
+	return certFile, keyFile, nil
+}
+
+// certValidFor reports whether the pair at certFile/keyFile exists, has not
+// expired and covers every host
+func certValidFor(certFile, keyFile string, hosts []string) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return false
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+
+	if err != nil {
+		return false
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		return false
+	}
+
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generateCertificate writes a self-signed certificate and key for hosts
+func generateCertificate(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"cstu"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(generatedCertLife),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
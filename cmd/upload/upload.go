@@ -3,30 +3,46 @@ package upload
 import (
 	"bytes"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"github.com/myENA/cstu/cmd"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/xanzy/go-cloudstack/cloudstack"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"text/template"
+	"time"
 )
 
 const (
 	synopsisMessage = "Uploads templates to cloudstack"
 	webPath         = "/opt/cows"
-	containerName   = "templateWeb"
+	containerPrefix = "templateWeb"
 	sleepTimer      = 15
-)
 
-var ctx context.Context
+	// interruptedStatus is returned when the upload was cancelled by a signal
+	interruptedStatus = 130
+	cleanupTimeout    = 2 * time.Minute
+
+	tlsHelpMessage = `
+HTTPS:
+  With --tls templates are registered with https:// urls. The secondary storage
+  VMs download them and must trust the serving certificate, otherwise the
+  download fails with a certificate error. Before the first upload, import the
+  CA that signed --tls-cert (or the generated cstu.crt from --tls-dir) into
+  CloudStack, e.g. with the uploadCustomCertificate API, and restart the
+  secondary storage VMs so they pick it up. The generated certificate is only
+  valid for the host address, so it is regenerated if the address changes.
+`
+)
 
 type Options struct {
 	cmd.TemplateYAML `yaml:",inline"`
@@ -34,24 +50,104 @@ type Options struct {
 	zoneID           string
 	configFile       string
 	debug            bool
+	logLevel         string
+	logFormat        string
+	vars             varFlags
+	apiRetries       int
+	apiRetryWait     time.Duration
+	apiRetryMaxWait  time.Duration
 	cleanup          bool
 	system           bool
-	setResourceTags  bool
-	resourceTags     string
+	tags             varFlags
+	journalFile      string
+	auditFile        string
+	lockTTL          time.Duration
+	forceUnlock      bool
+	resultsFile      string
+	metricsAddr      string
+	metricsFile      string
+	stagingRoot      string
+	stagingMode      string
+	tls              bool
+	tlsCert          string
+	tlsKey           string
+	tlsDir           string
+	builtin          bool
+	restrictSSVM     bool
 }
 
 // Command represents the upload subcommand
 type Command struct {
-	Self    string
-	Log     zerolog.Logger
-	args    *Options
-	urlPath string
-	cID     string
-	cfs     *flag.FlagSet
+	Self     string
+	Log      zerolog.Logger
+	Redactor *cmd.Redactor
+	args     *Options
+	urlPath  string
+	cID      string
+	cfs      *flag.FlagSet
+	journal  *journal
+	ctx      context.Context
+	cancel   context.CancelFunc
+	serving  bool
+	remote   string
+
+	// api requests made after an interrupt, while the run cleans up
+	cleanupCtx    context.Context
+	cleanupCancel context.CancelFunc
+
+	// presigned url of the template in the object storage of the current environment
+	objectURL string
+
+	// per run staging directory and web container
+	stagingDir string
+	webName    string
+	webPort    int
+
+	// builtin web server and the path token of the current registration
+	server *templateServer
+	token  string
+
+	results []*targetResult
+	started time.Time
+	metrics *metrics
+	// records every change made in CloudStack
+	auditLog *auditLog
+	// keeps other runs on this host from updating the template
+	lockFile string
+	// templates leased to this run and when their leases are renewed
+	leases map[string]time.Time
+
+	// name and displayText templates, the name of the run and the variables they use
+	nameTmpl    *template.Template
+	displayTmpl *template.Template
+	vars        nameVars
+	runName     string
+
+	// current environment, the http client of its api and how long its async jobs may take
+	env          cmd.CloudstackEnvironment
+	httpClient   *http.Client
+	asyncTimeout time.Duration
+
+	// owner of the templates in the current environment
+	owner templateOwner
+
+	// environment, zone, template and step currently uploaded to, logged with every line
+	baseLog    zerolog.Logger
+	envName    string
+	zoneName   string
+	templateID string
+	phase      string
+
+	// templates registered by this run that are not yet safe to keep
+	createdMu sync.Mutex
+	created   []createdTemplate
 }
 
-func init() {
-	ctx = context.Background()
+// createdTemplate is a template registered by this run, deleted again if the
+// run is interrupted before its zone completes
+type createdTemplate struct {
+	cs    *cloudstack.CloudStackClient
+	entry *journalEntry
 }
 
 func (c *Command) setupFlags(args []string) error {
@@ -61,10 +157,34 @@ func (c *Command) setupFlags(args []string) error {
 	}
 
 	c.cfs = flag.NewFlagSet("upload", flag.ExitOnError)
+	c.args.vars = make(varFlags)
+	c.args.tags = make(varFlags)
+	c.cfs.Var(c.args.tags, "tag", "Resource tag for the new template as key=value, overrides resourceTags. Can be repeated")
+	c.cfs.Var(c.args.vars, "var", "Variable for the name and displayText templates as key=value, used as {{.Var.key}}. Can be repeated")
 	c.cfs.StringVar(&c.args.configFile, "configFile", "", "Template yaml file")
-	c.cfs.BoolVar(&c.args.cleanup, "cleanup", false, "Remove the template from webroot after cleanup")
-	c.cfs.BoolVar(&c.args.debug, "debug", false, "Enable debug logs")
-	c.cfs.BoolVar(&c.args.system, "system-service", false, "Use the system httpd service. Must still have a directory at /opt/cows")
+	c.cfs.BoolVar(&c.args.cleanup, "cleanup", false, "Deprecated: the per run staging directory is always removed")
+	c.cfs.BoolVar(&c.args.debug, "debug", false, "Enable debug logs, same as --log-level debug")
+	c.cfs.StringVar(&c.args.logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	c.cfs.StringVar(&c.args.logFormat, "log-format", cmd.LogFormatConsole, "Log format: console or json")
+	c.cfs.BoolVar(&c.args.system, "system-service", false, "Use the system httpd service on port 80. Staging directories are created in /opt/cows")
+	c.cfs.BoolVar(&c.args.builtin, "builtin-server", false, "Serve templates from a web server built into cstu instead of an httpd container")
+	c.cfs.BoolVar(&c.args.restrictSSVM, "restrict-ssvm", false, "Only let the secondary storage VMs of a zone download the template. Requires --builtin-server, the httpd container and system service serve anyone reaching the host")
+	c.cfs.StringVar(&c.args.stagingRoot, "staging-dir", "", "Directory the per run staging directory is created in (default system temp dir, /opt/cows with --system-service)")
+	c.cfs.StringVar(&c.args.stagingMode, "staging-mode", stageSymlink, "How the template is staged: symlink, hardlink or copy")
+	c.cfs.BoolVar(&c.args.tls, "tls", false, "Serve templates over https. The system service must already serve /opt/cows on port 443")
+	c.cfs.StringVar(&c.args.tlsCert, "tls-cert", "", "PEM certificate for the web container (default generates a self-signed certificate)")
+	c.cfs.StringVar(&c.args.tlsKey, "tls-key", "", "PEM key for --tls-cert")
+	c.cfs.StringVar(&c.args.tlsDir, "tls-dir", "", "Directory the self-signed certificate is generated in and reused from (default ~/.cstu/tls)")
+	c.cfs.StringVar(&c.args.resultsFile, "results", "", "Write the outcome of every environment/zone to this JSON file, with download progress when using --builtin-server")
+	c.cfs.StringVar(&c.args.metricsAddr, "metrics-addr", "", "Serve prometheus metrics on this address at /metrics while uploading, e.g. :9273")
+	c.cfs.StringVar(&c.args.metricsFile, "metrics-textfile", "", "Write prometheus metrics to this node_exporter textfile collector file at exit")
+	c.cfs.IntVar(&c.args.apiRetries, "api-retries", 4, "Times a CloudStack API call is retried on network errors, 5xx responses and throttling")
+	c.cfs.DurationVar(&c.args.apiRetryWait, "api-retry-wait", time.Second, "Wait before the first API retry, doubled for every following retry")
+	c.cfs.DurationVar(&c.args.apiRetryMaxWait, "api-retry-max-wait", 30*time.Second, "Longest wait between API retries")
+	c.cfs.StringVar(&c.args.journalFile, "journal", "", "Journal file used to resume interrupted uploads (default <configFile>.journal)")
+	c.cfs.DurationVar(&c.args.lockTTL, "lock-ttl", defaultLockTTL, "How long the locks of a run are honoured by other runs, leases are renewed halfway while a run waits on CloudStack")
+	c.cfs.BoolVar(&c.args.forceUnlock, "force-unlock", false, "Take over the locks of another run updating the same template, when it is known to be gone")
+	c.cfs.StringVar(&c.args.auditFile, "audit-file", "", "JSON Lines file every CloudStack change is recorded in (default $"+cmd.AuditFileEnv+" or ~/.cstu/audit.jsonl)")
 
 	// always okay
 	return c.cfs.Parse(args)
@@ -87,6 +207,10 @@ func (c *Command) requiredPassed() error {
 		if e.APISecret == "" {
 			return fmt.Errorf("api secret must was not passed for %s environment", e.Name)
 		}
+
+		if err := validateOwner(e); err != nil {
+			return err
+		}
 	}
 
 	if c.args.Name == "" {
@@ -113,8 +237,69 @@ func (c *Command) requiredPassed() error {
 		return fmt.Errorf("--os must be passed")
 	}
 
-	if c.args.HostIP == "" {
-		return fmt.Errorf("--host-ip must be passed and must be reachable by cloudstack")
+	if c.args.builtin && c.args.system {
+		return fmt.Errorf("--builtin-server and --system-service can not be used together")
+	}
+
+	if c.args.restrictSSVM && !c.args.builtin {
+		return fmt.Errorf("--restrict-ssvm requires --builtin-server")
+	}
+
+	if c.args.AdvertisedURL != "" {
+		u, err := url.Parse(c.args.AdvertisedURL)
+
+		if err != nil {
+			return fmt.Errorf("invalid advertisedURL %s: %s", c.args.AdvertisedURL, err)
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("advertisedURL must be an absolute http or https url")
+		}
+	}
+
+	if c.args.TemplateFile != "" && c.args.TemplateURL != "" {
+		return fmt.Errorf("only one of templateFile and templateURL may be set")
+	}
+
+	if c.args.TemplateFile == "" && c.args.TemplateURL == "" {
+		return fmt.Errorf("templateFile or templateURL must be set")
+	}
+
+	for _, h := range c.args.Webhooks {
+		if !isHTTPURL(h.URL) {
+			return fmt.Errorf("webhook url %s must be an http or https url", h.URL)
+		}
+
+		if h.Format != "" && h.Format != webhookJSON && h.Format != webhookSlack {
+			return fmt.Errorf("webhook format must be %s or %s", webhookJSON, webhookSlack)
+		}
+	}
+
+	for _, st := range c.smokeTests() {
+		if st.ServiceOffering == "" {
+			return fmt.Errorf("smokeTest needs a serviceOffering")
+		}
+
+		if st.PhoneHome && !c.args.builtin {
+			return fmt.Errorf("smokeTest phoneHome requires --builtin-server")
+		}
+
+		// the VM phones home to the builtin server, which only runs on a host serving a template file
+		if st.PhoneHome && c.remoteTemplateURL() != "" {
+			return fmt.Errorf("smokeTest phoneHome can not be used with a template url")
+		}
+	}
+
+	switch c.args.InUsePolicy {
+	case "", inUseSkip, inUseDeprecate, inUseDelete:
+	default:
+		return fmt.Errorf("inUsePolicy must be %s, %s or %s", inUseSkip, inUseDeprecate, inUseDelete)
+	}
+
+	switch c.args.ReplaceRule {
+	case "", replaceNewest, replaceOldest, replaceFail:
+	default:
+		return fmt.Errorf("replaceRule must be %s, %s or %s", replaceNewest, replaceOldest, replaceFail)
 	}
 
 	return nil
@@ -128,38 +313,100 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if err := c.setupLogging(); err != nil {
+		c.Log.Error().Msgf("%s", err)
+		return 1
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer c.cancel()
+
+	c.cleanupCtx, c.cleanupCancel = context.WithCancel(context.Background())
+	defer c.cleanupCancel()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	signal.Notify(sigChan, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
 
-	errChan := make(chan int, 10)
+	done := make(chan int, 1)
 
 	go func() {
-		errChan <- c.register(args)
+		done <- c.register(args)
 	}()
 
 	select {
 	case sig := <-sigChan:
-		c.Log.Info().Msgf("Received interrupt signal: %v", sig)
-		c.Log.Info().Msg("Cleaning up container")
-		if err := c.deleteContainer(c.cID); err != nil {
-			return 1
+		// register scopes c.Log to the zone it uploads to, so it is not ours to read
+		c.baseLog.Info().Msgf("Received interrupt signal: %v", sig)
+		c.cancel()
+
+		// the run cleans up as it unwinds, while it still holds its locks
+		cleanupTimer := time.AfterFunc(cleanupTimeout, c.cleanupCancel)
+		defer cleanupTimer.Stop()
+
+		c.baseLog.Info().Msg("Waiting for in-flight requests to stop and the run to clean up, interrupt again to exit right away")
+		select {
+		case <-done:
+		case <-sigChan:
+			c.cleanupCancel()
+			c.baseLog.Warn().Msg("Received second interrupt signal, exiting without cleaning up, rerun to resume from the journal")
 		}
 
-		c.Log.Info().Msg("Moving template back")
-		if err := os.Rename(fmt.Sprintf("%s/%s.qcow2", webPath, c.args.Name), c.args.TemplateFile); err != nil {
-			c.Log.Error().Msgf("Failed moving %s.qcow2 back to %s", c.args.Name, c.args.TemplateFile)
-			return 1
+		return interruptedStatus
+
+	case status := <-done:
+		return status
+	}
+}
+
+// cleanupInterrupted removes the templates this run registered in zones it
+// did not complete before it was interrupted. It runs as register unwinds, so
+// before the locks are released and the run is reported.
+func (c *Command) cleanupInterrupted() {
+	if c.ctx.Err() == nil {
+		return
+	}
+
+	c.createdMu.Lock()
+	created := c.created
+	c.created = nil
+	c.createdMu.Unlock()
+
+	for _, t := range created {
+		c.Log.Info().Msgf("Deleting template %s registered by this run in %s/%s", t.entry.NewID, t.entry.Environment, t.entry.Zone)
+		if !c.deleteExistingTemplate(t.cs, t.entry.NewID) {
+			continue
 		}
 
-	case err := <-errChan:
-		if err != 0 {
-			log.Printf("Error received: %v", err)
-			os.Exit(1)
+		t.entry.NewID = ""
+		t.entry.Ready = false
+		t.entry.Tagged = false
+		if err := c.journal.record(t.entry); err != nil {
+			c.Log.Error().Msgf("%s", err)
 		}
 	}
+}
 
-	return 0
+// trackCreated remembers a template registered by this run until its zone completes
+func (c *Command) trackCreated(cs *cloudstack.CloudStackClient, entry *journalEntry) {
+	c.createdMu.Lock()
+	defer c.createdMu.Unlock()
+
+	c.created = append(c.created, createdTemplate{cs: cs, entry: entry})
+}
+
+// untrackCreated stops tracking the template registered for entry, once
+// deleting it on interrupt would no longer leave the zone in a usable state
+func (c *Command) untrackCreated(entry *journalEntry) {
+	c.createdMu.Lock()
+	defer c.createdMu.Unlock()
+
+	for i, t := range c.created {
+		if t.entry == entry {
+			c.created = append(c.created[:i], c.created[i+1:]...)
+			return
+		}
+	}
 }
 
 func (c *Command) Synopsis() string {
@@ -174,6 +421,7 @@ func (c *Command) Help() string {
 	b := &bytes.Buffer{}
 	c.cfs.SetOutput(b)
 	c.cfs.Usage()
+	b.WriteString(tlsHelpMessage)
 	return b.String()
 }
 
@@ -198,195 +446,698 @@ func (c *Command) register(args []string) int {
 		return 1
 	}
 
+	c.redactConfig()
+	c.scopeLog()
+
 	// Make sure required Options are set
 	if err = c.requiredPassed(); err != nil {
 		c.Log.Error().Msg(err.Error())
 		return 1
 	}
 
-	if c.args.debug {
-		c.Log.Level(zerolog.DebugLevel)
+	if err = c.parseNames(); err != nil {
+		c.Log.Error().Msg(err.Error())
+		return 1
+	}
+
+	// nothing may change in CloudStack without a record of it
+	if c.auditLog, err = openAudit(c.args.auditFile); err != nil {
+		c.Log.Error().Msg(err.Error())
+		return 1
+	}
+
+	c.remote = c.remoteTemplateURL()
+
+	if c.remote != "" {
+		// the template is already hosted, so there is nothing to stage or serve
+		if err := c.checkRemoteTemplate(); err != nil {
+			c.Log.Error().Msgf("%s", err)
+			return 1
+		}
+	} else {
+		if _, err := os.Stat(c.args.TemplateFile); os.IsNotExist(err) {
+			c.Log.Error().Msgf("Cannot find %s: %s", c.args.TemplateFile, err)
+			return 1
+		}
+
+		// staging and serving only happen once an environment needs them
+		defer c.removeStaging()
+		defer c.stopServing()
+
+		hostIP, err := cmd.SelectHostIP(c.args.HostIP, c.args.HostInterface, c.args.HostCIDR)
+
+		if err != nil {
+			c.Log.Error().Msgf("%s", err)
+			return 1
+		}
+
+		c.Log.Info().Msgf("Serving templates from host address %s", hostIP)
+		c.args.HostIP = hostIP
+	}
+
+	if c.args.journalFile == "" {
+		c.args.journalFile = c.args.configFile + ".journal"
+	}
+
+	template, err := templateIdentity(c.args.TemplateFile, c.remote)
+
+	if err != nil {
+		c.Log.Error().Msgf("Unable to identify template: %s", err)
+		return 1
 	}
 
-	if _, err := os.Stat(c.args.TemplateFile); os.IsNotExist(err) {
-		c.Log.Error().Msgf("Cannot find %s: %s", c.args.TemplateFile, err)
+	var resumed bool
+	c.journal, resumed, err = loadJournal(c.args.journalFile, runFingerprint(configFile, template, c.runName))
+
+	if err != nil {
+		c.Log.Error().Msgf("%s", err)
 		return 1
 	}
 
-	if err := c.templateToWebRoot(); err != nil {
+	if resumed {
+		c.Log.Info().Msgf("Resuming previous upload from journal %s", c.args.journalFile)
+	}
+
+	if err := c.acquireHostLock(); err != nil {
 		c.Log.Error().Msgf("%s", err)
 		return 1
 	}
 
-	hostIP := cmd.GetOutboundIP()
+	defer c.releaseHostLock()
 
-	if hostIP != c.args.HostIP {
-		c.args.HostIP = hostIP
+	defer c.reportResults()
+
+	c.started = time.Now()
+	defer c.notifyRun()
+
+	c.metrics = newMetrics()
+
+	if c.args.metricsAddr != "" {
+		if err := c.metrics.serve(c.args.metricsAddr); err != nil {
+			c.Log.Error().Msgf("%s", err)
+			return 1
+		}
+
+		c.Log.Info().Msgf("Serving metrics on %s/metrics", c.args.metricsAddr)
+		defer c.metrics.stop()
+	}
+
+	if c.args.metricsFile != "" {
+		defer c.writeMetrics()
 	}
 
-	c.urlPath = fmt.Sprintf("http://%s", c.args.HostIP)
+	defer c.cleanupInterrupted()
 
 	for _, e := range c.args.CSEnvironments {
+		if errCode := c.uploadEnvironment(e); errCode != 0 {
+			return errCode
+		}
+	}
+
+	if err := c.journal.remove(); err != nil {
+		c.Log.Error().Msgf("Could not remove journal %s: %s", c.args.journalFile, err)
+	}
+
+	return 0
+}
+
+// uploadEnvironment uploads the template to every zone of an environment
+func (c *Command) uploadEnvironment(e cmd.CloudstackEnvironment) int {
+	var err error
+
+	c.envName = e.Name
+	c.zoneName = ""
+	c.templateID = ""
+	c.args.Name = c.runName
+	c.setPhase(phasePrepare)
+
+	c.Log.Debug().Msgf("APIUrl: %s", e.APIURL)
+
+	cs, err := c.newClient(e)
+
+	if err != nil {
+		return c.failEnvironment(e, err)
+	}
+
+	c.Log.Info().Msgf("Getting os id for %s", c.args.OSType)
+	c.args.osID, err = c.getOSID(cs, c.args.OSType)
+
+	if err != nil {
+		return c.failEnvironment(e, err)
+	}
+
+	c.owner, err = c.resolveOwner(cs, e)
+
+	if err != nil {
+		return c.failEnvironment(e, err)
+	}
 
-		var exists = false
-		var existingID string
+	c.Log.Info().Msgf("Templates are owned by %s", c.owner)
 
-		c.Log.Debug().Msgf("APIUrl: %s", e.APIURL)
-		c.Log.Debug().Msgf("APIKey: %s", e.APIKey)
-		c.Log.Debug().Msgf("SecretKey: %s", e.APISecret)
+	if e.ObjectStorage != nil && c.remote == "" && !c.journal.envDone(e.Name, e.Zones) {
+		obj, err := c.uploadObject(e.ObjectStorage)
 
-		cs := cloudstack.NewAsyncClient(e.APIURL, e.APIKey, e.APISecret, false)
+		if err != nil {
+			return c.failEnvironment(e, err)
+		}
+
+		// zones that fail still remove the object, only this run uses it
+		defer c.removeObject(obj)
+		defer func() { c.objectURL = "" }()
+
+		c.objectURL = obj.url
+	}
+
+	c.Log.Info().Msgf("Zones %d", len(e.Zones))
 
-		c.Log.Info().Msgf("Getting os id for %s", c.args.OSType)
-		c.args.osID, err = c.getOSID(cs, c.args.OSType)
+	for _, z := range e.Zones {
+		c.zoneName = z
+		c.templateID = ""
+
+		nameErr := c.renderNames(e.Name, z)
+		c.setPhase(phaseLookup)
+
+		res := c.newResult(e.Name, z)
+
+		if nameErr != nil {
+			c.finishResult(res, resultFailed, nameErr)
+			c.Log.Error().Msgf("%s", nameErr)
+			return 1
+		}
+
+		status, err := c.uploadZone(cs, e.Name, z, res)
+		c.finishResult(res, status, err)
 
 		if err != nil {
 			c.Log.Error().Msgf("%s", err)
 			return 1
 		}
+	}
+
+	return 0
+}
 
-		c.Log.Info().Msgf("Zones %d", len(e.Zones))
+// failEnvironment records err for every zone of an environment that can not be uploaded to
+func (c *Command) failEnvironment(e cmd.CloudstackEnvironment, err error) int {
+	c.Log.Error().Msgf("%s", err)
 
-		for _, z := range e.Zones {
+	for _, z := range e.Zones {
+		c.finishResult(c.newResult(e.Name, z), resultFailed, err)
+	}
 
-			c.Log.Info().Msgf("Getting Zone id for %s", z)
-			c.args.zoneID, _, err = cs.Zone.GetZoneID(z)
+	return 1
+}
 
-			if err != nil {
-				c.Log.Error().Msgf("%s", err)
-				return 1
-			}
+// uploadZone runs every upload step for a single zone, skipping the steps
+// already recorded in the journal by a previous run
+func (c *Command) uploadZone(cs *cloudstack.CloudStackClient, env, zone string, res *targetResult) (string, error) {
+	var err error
 
-			c.Log.Info().Msgf("Checking if template %s exists", c.args.Name)
-			templ := c.checkTemplateExists(cs, c.args.Name, c.args.zoneID)
+	entry := c.journal.entry(env, zone)
 
-			if templ != nil {
-				c.Log.Info().Msgf("Found a template with the same Name, saving ID %s for deletion later", templ.Id)
-				c.args.TemplateTag = templ.Templatetag
-				exists = true
-				existingID = templ.Id
+	if err := c.ctx.Err(); err != nil {
+		return resultFailed, err
+	}
+
+	if entry.Done {
+		c.Log.Info().Msgf("Template %s was already uploaded to %s/%s, skipping", c.args.Name, env, zone)
+		res.TemplateID = entry.NewID
+		res.ReplacedID = entry.ExistingID
+		return resultSkipped, nil
+	}
+
+	c.Log.Info().Msgf("Getting Zone id for %s", zone)
+	c.args.zoneID, err = c.getZoneID(cs, zone)
+
+	if err != nil {
+		return resultFailed, err
+	}
+
+	// the template being replaced is leased before the check is journaled, so a
+	// journal never holds a template another run is replacing
+	var leased, claimed string
+	defer func() {
+		if leased != "" {
+			c.releaseLease(cs, leased)
+		}
+
+		if claimed != "" {
+			c.releaseClaim(cs, claimed)
+			c.releaseLease(cs, claimed)
+		}
+	}()
+
+	if !entry.Checked {
+		c.Log.Info().Msgf("Checking if template %s exists", c.args.Name)
+		templ, duplicates, err := c.checkTemplateExists(cs, c.args.Name, c.args.zoneID)
+
+		if err != nil {
+			return resultFailed, err
+		}
+
+		if templ != nil {
+			if err := c.acquireLease(cs, templ.Id); err != nil {
+				return resultFailed, err
 			}
 
-			if !c.args.system {
-				if errCode := c.startWebContainer(); errCode != 0 {
-					return errCode
-				}
+			leased = templ.Id
+
+			c.Log.Info().Msgf("Found a template with the same Name, saving ID %s for deletion later", templ.Id)
+			entry.ExistingID = templ.Id
+			entry.TemplateTag = templ.Templatetag
+		}
+
+		for _, d := range duplicates {
+			if c.args.CleanupDuplicates {
+				c.Log.Info().Msgf("Found duplicate template %s created %s, saving it for deletion later", d.Id, d.Created)
+				entry.Duplicates = append(entry.Duplicates, d.Id)
 			} else {
-				if err := checkSystemHTTPPort(); err != nil {
-					c.Log.Error().Msgf("Error checking host http service port: %s. Trying to start docker container")
-					c.args.system = false
-					if errCode := c.startWebContainer(); errCode != 0 {
-						return errCode
-					}
-				}
+				c.Log.Warn().Msgf("Found duplicate template %s created %s, set cleanupDuplicates to delete it", d.Id, d.Created)
 			}
+		}
 
-			newTempl, err := c.registerTemplate(cs)
+		entry.Checked = true
+		if err := c.journal.record(entry); err != nil {
+			return resultFailed, err
+		}
+	} else if entry.ExistingID != "" && !entry.OldDeleted {
+		if err := c.resumeExisting(cs, entry); err != nil {
+			return resultFailed, err
+		}
 
-			if err != nil {
-				c.Log.Error().Msgf("%s", err)
-
-				if !c.args.system {
-					c.Log.Info().Msg("Cleaning up docker container")
-					if err := c.deleteContainer(c.cID); err != nil {
-						c.Log.Error().Msgf("%s", err)
-						return 1
-					}
-				}
-				return 1
-			}
+		if entry.ExistingID != "" {
+			leased = entry.ExistingID
+		}
+	}
 
-			var newID string
+	res.ReplacedID = entry.ExistingID
 
-			c.Log.Info().Msg("Grabbing new template ID")
-			for _, t := range newTempl.RegisterTemplate {
-				if t.Name == c.args.Name && t.Id != existingID {
-					newID = t.Id
-					break
-				}
+	if !entry.Ready {
+		c.setPhase(phaseServe)
+		if err := c.startServing(); err != nil {
+			return resultFailed, err
+		}
+
+		if entry.NewID != "" {
+			c.setTemplateID(entry.NewID)
+			if err := c.reattach(cs, entry); err != nil {
+				return resultFailed, err
 			}
+		}
 
-			c.Log.Info().Msgf("Waiting for new template to be ready")
-			if err := c.watchRegisteredTemplate(cs, newID); err != nil {
-				c.Log.Error().Msgf("%s", err)
-				if !c.args.system {
-					c.Log.Info().Msg("Cleaning up docker container")
-					if err := c.deleteContainer(c.cID); err != nil {
-						c.Log.Error().Msgf("%s", err)
-						return 1
-					}
-				}
-				return 1
+		if entry.NewID == "" {
+			c.setPhase(phaseRegister)
+			if err := c.grantToken(cs); err != nil {
+				return resultFailed, err
 			}
 
-			if c.args.ResourceTags != nil {
-				c.Log.Info().Msgf("Creating resource tags for the new template: %s", c.args.Name)
-				if err := c.createResourceTags(cs, newID); err != nil {
-					c.Log.Error().Msgf("%s", err)
-					return 1
-				}
+			defer c.revokeToken()
+
+			// keep the template tag of the replaced template unless one is configured
+			templateTag := c.args.TemplateTag
+			if templateTag == "" {
+				templateTag = entry.TemplateTag
 			}
 
-			if exists {
-				c.Log.Info().Msgf("Deleting old template id %s", existingID)
-				c.deleteExistingTemplate(cs, existingID)
+			entry.NewID, err = c.registerTemplate(cs, templateTag)
+
+			if err != nil {
+				return resultFailed, err
+			}
+
+			c.setTemplateID(entry.NewID)
+			c.trackCreated(cs, entry)
+
+			entry.URL = c.templateURL()
+			if err := c.journal.record(entry); err != nil {
+				return resultFailed, err
 			}
 
-			if !c.args.system {
-				c.Log.Info().Msg("Stopping the httpd container")
-				if err := c.deleteContainer(c.cID); err != nil {
-					c.Log.Error().Msgf("%s", err)
-					return 1
+			if entry.ExistingID == "" {
+				claimed = entry.NewID
+				if err := c.claimTemplate(cs, entry); err != nil {
+					return resultFailed, err
 				}
 			}
-			c.Log.Info().Msgf("Your new Template %s with ID %s is ready for use", c.args.Name, newID)
+		}
+
+		res.TemplateID = entry.NewID
+
+		c.setPhase(phaseWait)
+		c.Log.Info().Msgf("Waiting for new template to be ready")
+		waitStart := time.Now()
+		err := c.watchRegisteredTemplate(c.ctx, cs, entry.NewID)
+		res.ReadyWait = time.Since(waitStart).Seconds()
 
+		if c.server != nil && c.token != "" {
+			res.Downloads = c.server.progress(c.token)
+
+			if err != nil && c.ctx.Err() == nil {
+				err = fmt.Errorf("%s: %s", err, diagnoseDownload(res.Downloads))
+			}
 		}
 
+		if err != nil {
+			return resultFailed, err
+		}
+
+		c.revokeToken()
+
+		entry.Ready = true
+		if err := c.journal.record(entry); err != nil {
+			return resultFailed, err
+		}
 	}
 
-	if c.args.cleanup {
-		if err := os.Remove(fmt.Sprintf("%s/%s.qcow2", webPath, c.args.Name)); err != nil {
-			c.Log.Error().Msgf("Could not cleanup the template from the %s, please remove manually: %s",
-				fmt.Sprintf("%s/%s.qcow2", webPath, c.args.Name), err)
-			return 0
+	res.TemplateID = entry.NewID
+	c.setTemplateID(entry.NewID)
+
+	// a resumed first upload claims its template again
+	if entry.ExistingID == "" && claimed == "" {
+		claimed = entry.NewID
+		if err := c.claimTemplate(cs, entry); err != nil {
+			return resultFailed, err
 		}
 	}
 
-	return 0
+	if c.smokeTestConfig() != nil && !entry.Tested {
+		c.setPhase(phaseSmoke)
+		if err := c.smokeTest(cs, entry.NewID); err != nil {
+			// the working template must stay until a new one is proven to boot
+			return resultFailed, fmt.Errorf("%s, template %s is kept for inspection and %s was not replaced", err, entry.NewID, c.args.Name)
+		}
+
+		entry.Tested = true
+		if err := c.journal.record(entry); err != nil {
+			return resultFailed, err
+		}
+	}
+
+	if (len(c.managedTags()) > 0 || c.args.CarryOverTags) && !entry.Tagged {
+		c.setPhase(phaseTag)
+		c.Log.Info().Msgf("Syncing resource tags for the new template: %s", c.args.Name)
+		if err := c.syncTags(cs, entry.NewID, entry.ExistingID); err != nil {
+			return resultFailed, err
+		}
+
+		entry.Tagged = true
+		if err := c.journal.record(entry); err != nil {
+			return resultFailed, err
+		}
+	}
+
+	if err := c.ctx.Err(); err != nil {
+		return resultFailed, err
+	}
+
+	// the new template is usable from here on, so an interrupt must no longer remove it
+	c.untrackCreated(entry)
+
+	if entry.ExistingID != "" && !entry.OldDeleted {
+		c.setPhase(phaseCleanup)
+
+		// another run may have taken over an expired lease while this one uploaded
+		if err := c.checkLease(cs, entry.ExistingID); err != nil {
+			return resultFailed, fmt.Errorf("%s, old template %s was not deleted", err, entry.ExistingID)
+		}
+
+		// moved profiles no longer list under the old template, so a resumed run finds only the rest
+		moved, err := c.moveAutoScaleProfiles(cs, entry.ExistingID, entry.NewID)
+		res.AutoScaleProfiles = append(res.AutoScaleProfiles, moved...)
+
+		if err != nil {
+			return resultFailed, fmt.Errorf("%s, old template %s was not deleted", err, entry.ExistingID)
+		}
+
+		c.Log.Info().Msgf("Deleting old template id %s", entry.ExistingID)
+		if !c.retireTemplate(cs, entry.ExistingID, entry.NewID, res) {
+			// the journal keeps the old template, so a rerun retries the cleanup
+			c.releaseAlias(cs, entry.ExistingID)
+			return resultFailed, fmt.Errorf("new template %s is ready but old template %s was not removed, run again to retry", entry.NewID, entry.ExistingID)
+		}
+
+		entry.OldDeleted = true
+		if err := c.journal.record(entry); err != nil {
+			return resultFailed, err
+		}
+	}
+
+	if len(entry.Duplicates) > 0 {
+		c.setPhase(phaseCleanup)
+		if err := c.deleteDuplicates(cs, entry, res); err != nil {
+			return resultFailed, err
+		}
+	}
+
+	entry.Done = true
+	if err := c.journal.record(entry); err != nil {
+		return resultFailed, err
+	}
+
+	c.Log.Info().Msgf("Your new Template %s with ID %s is ready for use", c.args.Name, entry.NewID)
+
+	return resultUploaded, nil
+}
+
+// resumeExisting leases the template saved for deletion by a previous run
+// again. If it was removed in the meantime there is nothing left to replace.
+func (c *Command) resumeExisting(cs *cloudstack.CloudStackClient, entry *journalEntry) error {
+	_, err := c.getTemplate(cs, entry.ExistingID)
+
+	if _, ok := err.(templateNotFound); ok {
+		c.Log.Warn().Msgf("Template %s saved for deletion is gone, nothing left to replace", entry.ExistingID)
+		entry.ExistingID = ""
+		return c.journal.record(entry)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to check template %s saved for deletion: %s", entry.ExistingID, err)
+	}
+
+	c.Log.Info().Msgf("Resuming with existing template ID %s saved for deletion later", entry.ExistingID)
+
+	return c.acquireLease(cs, entry.ExistingID)
+}
+
+// reattach checks whether a template registered by a previous run can still
+// finish downloading, clearing it from the journal entry otherwise. Only a
+// template fetched from a --url keeps its url across runs; a served template
+// gets a new staging directory, port and token, so one that is still
+// downloading is registered again.
+func (c *Command) reattach(cs *cloudstack.CloudStackClient, entry *journalEntry) error {
+	templ, err := c.getTemplate(cs, entry.NewID)
+
+	if _, ok := err.(templateNotFound); ok {
+		c.Log.Info().Msgf("Previously registered template %s is gone, registering again", entry.NewID)
+		entry.NewID = ""
+		return c.journal.record(entry)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to check previously registered template %s: %s", entry.NewID, err)
+	}
+
+	if !templ.Isready && entry.URL != c.templateURL() {
+		if err := probeURL(c.ctx, entry.URL); err != nil {
+			c.Log.Info().Msgf("Previously registered template %s downloads from %s which is no longer served, registering again", entry.NewID, entry.URL)
+			c.deleteExistingTemplate(cs, entry.NewID)
+			entry.NewID = ""
+			return c.journal.record(entry)
+		}
+	}
+
+	c.Log.Info().Msgf("Re-attaching to previously registered template %s with status: %s", templ.Id, templ.Status)
+
+	return nil
+}
+
+// startServing makes the staged template available to CloudStack. The web
+// server is started once and shared by every zone of the run.
+func (c *Command) startServing() error {
+	if c.serving || c.remote != "" || c.objectURL != "" {
+		return nil
+	}
+
+	if c.args.builtin {
+		if err := c.startBuiltinServer(); err != nil {
+			return err
+		}
+
+		c.serving = true
+
+		return nil
+	}
+
+	if c.stagingDir == "" {
+		if err := c.stageTemplate(); err != nil {
+			return err
+		}
+	}
+
+	if c.args.system {
+		c.urlPath = fmt.Sprintf("%s://%s", c.scheme(), cmd.URLHost(c.args.HostIP, 0))
+
+		if err := checkSystemHTTPPort(c.urlPath); err != nil {
+			c.Log.Error().Msgf("Error checking host http service port: %s. Trying to start docker container", err)
+			c.args.system = false
+		} else if c.args.AdvertisedURL != "" {
+			if err := c.waitServed(c.ctx, "Advertised url", c.templateURL()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !c.args.system {
+		if err := c.startWebContainer(); err != nil {
+			return err
+		}
+	}
+
+	c.serving = true
+
+	return nil
 }
 
-func checkSystemHTTPPort() error {
-	client := http.Client{}
+// headURL makes sure url can be downloaded, returning the response to a HEAD request
+func headURL(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// probeURL checks that url still serves a download. It fetches a single
+// byte since presigned object storage urls only allow GET requests.
+func probeURL(ctx context.Context, url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Range", "bytes=0-0")
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
 
-	resp, err := client.Get(fmt.Sprintf("http://%s", cmd.GetOutboundIP()))
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	return nil
+}
+
+func checkSystemHTTPPort(url string) error {
+	resp, err := localClient().Get(url)
 
 	if err != nil {
 		return err
 	}
 
+	resp.Body.Close()
+
 	if resp.StatusCode != 200 {
-		return errors.New("unable to verify http service is running on port 80")
+		return fmt.Errorf("unable to verify http service is running at %s", url)
 	}
 
 	return nil
 
 }
 
-func (c *Command) startWebContainer() int {
-	if err := c.pullHttpd(); err != nil {
-		return 1
+func (c *Command) startWebContainer() error {
+	var err error
+
+	if c.webPort, err = freePort(); err != nil {
+		return fmt.Errorf("unable to find a free port for the web container: %s", err)
 	}
 
-	if err := c.runWebContainer(); err != nil {
-		c.Log.Error().Msgf("%s", err)
-		return 1
+	c.webName = fmt.Sprintf("%s-%s", containerPrefix, strings.TrimPrefix(filepath.Base(c.stagingDir), "cstu-"))
+	c.urlPath = fmt.Sprintf("%s://%s", c.scheme(), cmd.URLHost(c.args.HostIP, c.webPort))
+
+	if err := c.pullHttpd(c.ctx); err != nil {
+		return err
+	}
+
+	if err := c.runWebContainer(c.ctx); err != nil {
+		return err
 	}
 
 	c.Log.Info().Msg("Waiting for container to be active")
-	if err := c.containerActive(); err != nil {
+
+	return c.containerActive(c.ctx)
+}
+
+// stopServing stops whichever web server this run started
+func (c *Command) stopServing() {
+	if c.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+
+		c.Log.Info().Msg("Stopping the builtin web server")
+		if err := c.server.stop(ctx); err != nil {
+			c.Log.Error().Msgf("%s", err)
+		}
+
+		c.server = nil
+		c.serving = false
+	}
+
+	c.stopWebContainer()
+}
+
+// stopWebContainer removes the httpd container if one was started by this run
+func (c *Command) stopWebContainer() int {
+	if c.args.system || c.cID == "" {
+		return 0
+	}
+
+	// always stop the container, even when the run itself was cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	c.Log.Info().Msg("Stopping the httpd container")
+	if err := c.deleteContainer(ctx, c.cID); err != nil {
+		c.Log.Error().Msgf("%s", err)
 		return 1
 	}
 
+	c.cID = ""
+	c.serving = false
+
 	return 0
 }
+
+// sleepContext pauses for d, returning early with the context error if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
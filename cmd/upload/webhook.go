@@ -0,0 +1,183 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/myENA/cstu/cmd"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	webhookJSON  = "json"
+	webhookSlack = "slack"
+
+	defaultWebhookRetries = 3
+	webhookTimeout        = 10 * time.Second
+	webhookBackoff        = 2 * time.Second
+
+	runSucceeded   = "succeeded"
+	runFailed      = "failed"
+	runInterrupted = "interrupted"
+)
+
+// webhookPayload is the generic json body sent to webhooks. Event is target
+// when an environment/zone finished and run when the whole run finished.
+type webhookPayload struct {
+	Event       string  `json:"event"`
+	Template    string  `json:"template"`
+	Environment string  `json:"environment,omitempty"`
+	Zone        string  `json:"zone,omitempty"`
+	TemplateID  string  `json:"templateID,omitempty"`
+	ReplacedID  string  `json:"replacedID,omitempty"`
+	Status      string  `json:"status"`
+	Duration    float64 `json:"durationSeconds"`
+	Error       string  `json:"error,omitempty"`
+
+	// only set for the run event
+	Targets []webhookPayload `json:"targets,omitempty"`
+}
+
+func targetPayload(r *targetResult) webhookPayload {
+	return webhookPayload{
+		Event:       "target",
+		Template:    r.Template,
+		Environment: r.Environment,
+		Zone:        r.Zone,
+		TemplateID:  r.TemplateID,
+		ReplacedID:  r.ReplacedID,
+		Status:      r.Status,
+		Duration:    r.Duration,
+		Error:       r.Error,
+	}
+}
+
+// slackText renders a payload as a slack message
+func (p webhookPayload) slackText() string {
+	if p.Event == "run" {
+		lines := []string{fmt.Sprintf("Template *%s* upload %s after %.0fs", p.Template, p.Status, p.Duration)}
+
+		for _, t := range p.Targets {
+			lines = append(lines, "• "+t.slackText())
+		}
+
+		return strings.Join(lines, "\n")
+	}
+
+	switch p.Status {
+	case resultFailed:
+		return fmt.Sprintf("Template *%s* failed in %s/%s after %.0fs: %s", p.Template, p.Environment, p.Zone, p.Duration, p.Error)
+	case resultSkipped:
+		return fmt.Sprintf("Template *%s* was already uploaded to %s/%s", p.Template, p.Environment, p.Zone)
+	}
+
+	text := fmt.Sprintf("Template *%s* %s to %s/%s as %s in %.0fs", p.Template, p.Status, p.Environment, p.Zone, p.TemplateID, p.Duration)
+
+	if p.ReplacedID != "" {
+		text += fmt.Sprintf(", replacing %s", p.ReplacedID)
+	}
+
+	return text
+}
+
+// notifyTarget tells every webhook an environment/zone finished
+func (c *Command) notifyTarget(r *targetResult) {
+	c.notify(targetPayload(r))
+}
+
+// notifyRun tells every webhook the run finished, with the outcome of every target
+func (c *Command) notifyRun() {
+	p := webhookPayload{
+		Event:    "run",
+		Template: c.runName,
+		Status:   runSucceeded,
+		Duration: time.Since(c.started).Seconds(),
+	}
+
+	for _, r := range c.results {
+		if r.Status == resultFailed {
+			p.Status = runFailed
+		}
+
+		p.Targets = append(p.Targets, targetPayload(r))
+	}
+
+	if c.ctx.Err() != nil {
+		p.Status = runInterrupted
+	}
+
+	c.notify(p)
+}
+
+func (c *Command) notify(p webhookPayload) {
+	for _, h := range c.args.Webhooks {
+		if err := c.sendWebhook(h, p); err != nil {
+			c.Log.Error().Msgf("Unable to notify webhook %s: %s", h.URL, err)
+		}
+	}
+}
+
+// sendWebhook posts a payload to a webhook, retrying failed deliveries
+func (c *Command) sendWebhook(h cmd.Webhook, p webhookPayload) error {
+	var body interface{} = p
+
+	if h.Format == webhookSlack {
+		body = map[string]string{"text": p.slackText()}
+	}
+
+	data, err := json.Marshal(body)
+
+	if err != nil {
+		return err
+	}
+
+	retries := h.Retries
+
+	if retries <= 0 {
+		retries = defaultWebhookRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err = postWebhook(h.URL, data); err == nil {
+			return nil
+		}
+
+		if attempt >= retries {
+			return err
+		}
+
+		c.Log.Debug().Msgf("Webhook %s failed, retrying: %s", h.URL, err)
+		time.Sleep(time.Duration(attempt+1) * webhookBackoff)
+	}
+}
+
+func postWebhook(url string, data []byte) error {
+	// webhooks are also sent when the run was interrupted, so not bound to its context
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -1,54 +1,237 @@
 package cmd
 
 import (
-	"github.com/rs/zerolog"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
+// CloudstackEnvironment is a CloudStack api and the zones templates are
+// uploaded to. Templates are owned by the project, or the account within the
+// domain, given by name, by the account of the api keys when neither is set.
 type CloudstackEnvironment struct {
-	Name      string   `yaml:"name"`
-	APIURL    string   `yaml:"apiURL"`
-	APISecret string   `yaml:"apiSecret"`
-	APIKey    string   `yaml:"apiKey"`
-	Zones     []string `yaml:"zones"`
+	Name          string         `yaml:"name"`
+	APIURL        string         `yaml:"apiURL"`
+	APISecret     string         `yaml:"apiSecret"`
+	APIKey        string         `yaml:"apiKey"`
+	Zones         []string       `yaml:"zones"`
+	Project       string         `yaml:"project,omitempty"`
+	Domain        string         `yaml:"domain,omitempty"`
+	Account       string         `yaml:"account,omitempty"`
+	ObjectStorage *ObjectStorage `yaml:"objectStorage,omitempty"`
+	Transport     *Transport     `yaml:"transport,omitempty"`
+	SmokeTest     *SmokeTest     `yaml:"smokeTest,omitempty"`
+}
+
+// SmokeTest deploys a VM from a new template before the old one is deleted
+type SmokeTest struct {
+	// name or id
+	ServiceOffering string `yaml:"serviceOffering"`
+	// name or id, resolved in every zone
+	Network string `yaml:"network,omitempty"`
+	// tcp port that must accept connections on the VM
+	Port int `yaml:"port,omitempty"`
+	// the VM calls the builtin web server back from its user data
+	PhoneHome bool `yaml:"phoneHome,omitempty"`
+	// how long the VM may take, e.g. "10m"
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// Transport configures how the CloudStack api of an environment is reached.
+// Certificates are verified unless insecureSkipVerify is set.
+type Transport struct {
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+	CAFile             string `yaml:"caFile,omitempty"`
+	CertFile           string `yaml:"certFile,omitempty"`
+	KeyFile            string `yaml:"keyFile,omitempty"`
+	// proxy url, HTTPS_PROXY/HTTP_PROXY are used when blank
+	Proxy string `yaml:"proxy,omitempty"`
+	// per request timeout, e.g. "60s"
+	Timeout string `yaml:"timeout,omitempty"`
+	// how long to wait for async jobs such as deleteTemplate, e.g. "5m"
+	AsyncTimeout string `yaml:"asyncTimeout,omitempty"`
+}
+
+// ObjectStorage is an S3 compatible bucket templates are staged in instead of
+// being served from the build host
+type ObjectStorage struct {
+	Endpoint   string `yaml:"endpoint"`
+	Region     string `yaml:"region,omitempty"`
+	Bucket     string `yaml:"bucket"`
+	Prefix     string `yaml:"prefix,omitempty"`
+	AccessKey  string `yaml:"accessKey"`
+	SecretKey  string `yaml:"secretKey"`
+	DisableSSL bool   `yaml:"disableSSL,omitempty"`
+	URLTTL     string `yaml:"urlTTL,omitempty"`
+}
+
+// Webhook is a url notified when an environment/zone or the whole run finishes
+type Webhook struct {
+	URL string `yaml:"url"`
+	// json (default) or slack
+	Format  string `yaml:"format,omitempty"`
+	Retries int    `yaml:"retries,omitempty"`
 }
 
 type TemplateYAML struct {
-	Name            string                  `yaml:"name"`
-	CSEnvironments  []CloudstackEnvironment `yaml:"environments"`
-	HostIP          string                  `yaml:"hostIP"`
-	TemplateFile    string                  `yaml:"templateFile"`
-	TemplateID      string                  `yaml:"templateID"`
-	OSType          string                  `yaml:"osType"`
-	Format          string                  `yaml:"format"`
-	HyperVisor      string                  `yaml:"hypervisor"`
-	DisplayText     string                  `yaml:"displayText"`
-	IsPublic        bool                    `yaml:"isPublic"`
-	IsFeatured      bool                    `yaml:"isFeatured"`
-	PasswordEnabled bool                    `yaml:"passwordEnabled"`
-	IsDynamic       bool                    `yaml:"isDynamic"`
-	IsExtractable   bool                    `yaml:"isExtractable"`
-	IsRouting       bool                    `yaml:"isRouting"`
-	RequiresHVM     bool                    `yaml:"requiresHVM"`
-	SSHKeyEnabled   bool                    `yaml:"sshKeyEnabled"`
-	ProjectID       string                  `yaml:"projectID,omitempty"`
-	TemplateTag     string                  `yaml:"templateTag"`
-	ResourceTags    map[string]string       `yaml:"resourceTags"`
+	Name              string                     `yaml:"name"`
+	CSEnvironments    []CloudstackEnvironment    `yaml:"environments"`
+	HostIP            string                     `yaml:"hostIP"`
+	HostInterface     string                     `yaml:"hostInterface"`
+	HostCIDR          string                     `yaml:"hostCIDR"`
+	AdvertisedURL     string                     `yaml:"advertisedURL"`
+	TemplateFile      string                     `yaml:"templateFile"`
+	TemplateURL       string                     `yaml:"templateURL"`
+	TemplateID        string                     `yaml:"templateID"`
+	OSType            string                     `yaml:"osType"`
+	Format            string                     `yaml:"format"`
+	HyperVisor        string                     `yaml:"hypervisor"`
+	DisplayText       string                     `yaml:"displayText"`
+	IsPublic          bool                       `yaml:"isPublic"`
+	IsFeatured        bool                       `yaml:"isFeatured"`
+	PasswordEnabled   bool                       `yaml:"passwordEnabled"`
+	IsDynamic         bool                       `yaml:"isDynamic"`
+	IsExtractable     bool                       `yaml:"isExtractable"`
+	IsRouting         bool                       `yaml:"isRouting"`
+	RequiresHVM       bool                       `yaml:"requiresHVM"`
+	SSHKeyEnabled     bool                       `yaml:"sshKeyEnabled"`
+	Bits              int                        `yaml:"bits,omitempty"`
+	Checksum          string                     `yaml:"checksum,omitempty"`
+	DirectDownload    bool                       `yaml:"directDownload,omitempty"`
+	DeployAsIs        bool                       `yaml:"deployAsIs,omitempty"`
+	TemplateType      string                     `yaml:"templateType,omitempty"`
+	Details           map[string]string          `yaml:"details,omitempty"`
+	HypervisorOptions map[string]TemplateOptions `yaml:"hypervisorOptions,omitempty"`
+	ProjectID         string                     `yaml:"projectID,omitempty"`
+	TemplateTag       string                     `yaml:"templateTag"`
+	ResourceTags      map[string]string          `yaml:"resourceTags"`
+	CarryOverTags     bool                       `yaml:"carryOverTags,omitempty"`
+	Alias             string                     `yaml:"alias,omitempty"`
+	ReplaceTag        string                     `yaml:"replaceTag,omitempty"`
+	ReplaceRule       string                     `yaml:"replaceRule,omitempty"`
+	CleanupDuplicates bool                       `yaml:"cleanupDuplicates,omitempty"`
+	InUsePolicy       string                     `yaml:"inUsePolicy,omitempty"`
+	Webhooks          []Webhook                  `yaml:"webhooks,omitempty"`
+	SmokeTest         *SmokeTest                 `yaml:"smokeTest,omitempty"`
+}
+
+// TemplateOptions override the registration settings of a template for one
+// hypervisor. Details are merged with the template's details.
+type TemplateOptions struct {
+	IsDynamic      *bool             `yaml:"isDynamic,omitempty"`
+	RequiresHVM    *bool             `yaml:"requiresHVM,omitempty"`
+	DirectDownload *bool             `yaml:"directDownload,omitempty"`
+	DeployAsIs     *bool             `yaml:"deployAsIs,omitempty"`
+	Bits           int               `yaml:"bits,omitempty"`
+	TemplateType   string            `yaml:"templateType,omitempty"`
+	Details        map[string]string `yaml:"details,omitempty"`
 }
 
 // Get preferred outbound ip of this machine
 // https://stackoverflow.com/questions/23558425/how-do-i-get-the-local-ip-address-in-go
-func GetOutboundIP() string {
+// No packets are sent, but the host needs a route to the internet.
+func GetOutboundIP() (string, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
-		logger := zerolog.Logger{}
-		logger.Fatal().Msgf("%s", err)
+		return "", err
 	}
 	defer conn.Close()
 
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 
-	return localAddr.IP.String()
+	return localAddr.IP.String(), nil
+}
+
+// SelectHostIP picks the address CloudStack downloads templates from. An
+// explicit hostIP always wins. Otherwise the first address of hostInterface
+// and/or within hostCIDR is used, falling back to the outbound ip when
+// neither is set.
+func SelectHostIP(hostIP, hostInterface, hostCIDR string) (string, error) {
+	if hostIP != "" {
+		return strings.Trim(hostIP, "[]"), nil
+	}
+
+	var network *net.IPNet
+
+	if hostCIDR != "" {
+		_, n, err := net.ParseCIDR(hostCIDR)
+		if err != nil {
+			return "", fmt.Errorf("invalid hostCIDR %s: %s", hostCIDR, err)
+		}
+		network = n
+	}
+
+	if hostInterface == "" && network == nil {
+		ip, err := GetOutboundIP()
+		if err != nil {
+			return "", fmt.Errorf("unable to detect the host address, set hostIP, hostInterface or hostCIDR: %s", err)
+		}
+		return ip, nil
+	}
+
+	var ifaces []net.Interface
+
+	if hostInterface != "" {
+		iface, err := net.InterfaceByName(hostInterface)
+		if err != nil {
+			return "", fmt.Errorf("unable to find interface %s: %s", hostInterface, err)
+		}
+		ifaces = []net.Interface{*iface}
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return "", err
+		}
+		ifaces = all
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", fmt.Errorf("unable to list addresses of %s: %s", iface.Name, err)
+		}
+
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+
+			if network != nil && !network.Contains(ipNet.IP) {
+				continue
+			}
+
+			return ipNet.IP.String(), nil
+		}
+	}
+
+	switch {
+	case hostInterface != "" && network != nil:
+		return "", fmt.Errorf("interface %s has no address in %s", hostInterface, hostCIDR)
+	case hostInterface != "":
+		return "", fmt.Errorf("interface %s is down or has no usable address", hostInterface)
+	default:
+		return "", fmt.Errorf("no interface has an address in %s", hostCIDR)
+	}
+}
+
+// URLHost formats host for use in a url, adding the port if it is set and
+// bracketing IPv6 literals
+func URLHost(host string, port int) string {
+	if port != 0 {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+
+	return host
 }
 
 type AsyncJobResultsJobresult struct {
@@ -2,31 +2,36 @@ package main
 
 import (
 	"github.com/mitchellh/cli"
+	"github.com/myENA/cstu/cmd"
+	"github.com/myENA/cstu/cmd/audit"
 	"github.com/myENA/cstu/cmd/initialize"
 	"github.com/myENA/cstu/cmd/upload"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"os"
 )
 
 // package global logger
 var logger zerolog.Logger
 
+// masks secrets in everything logged
+var redactor *cmd.Redactor
+
 // available commands
 var cliCommands map[string]cli.CommandFactory
 
 // init command factory
 func init() {
 	// init logger
-	logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	logger.Level(zerolog.InfoLevel)
+	redactor = cmd.NewRedactor(os.Stderr)
+	logger, _ = cmd.NewLogger(redactor, cmd.LogFormatConsole, zerolog.InfoLevel.String())
 
 	// register sub commands
 	cliCommands = map[string]cli.CommandFactory{
 		"upload": func() (cli.Command, error) {
 			return &upload.Command{
-				Self: os.Args[0],
-				Log:  logger,
+				Self:     os.Args[0],
+				Log:      logger,
+				Redactor: redactor,
 			}, nil
 		},
 		"init": func() (cli.Command, error) {
@@ -35,5 +40,11 @@ func init() {
 				Log:  logger,
 			}, nil
 		},
+		"audit": func() (cli.Command, error) {
+			return &audit.Command{
+				Self: os.Args[0],
+				Log:  logger,
+			}, nil
+		},
 	}
 }